@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log-analyzer/internal/alert"
+	"log-analyzer/internal/anomaly"
+	"log-analyzer/internal/common"
+	"log-analyzer/internal/ingest"
+	server "log-analyzer/internal/server"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Input framings understood by analyze
+const (
+	formatAuto   = "auto"
+	formatRaw    = "raw" // one log line per line, optionally prefixed by an RFC3339 timestamp
+	formatJSON   = ingest.FormatJSON
+	formatNDJSON = ingest.FormatNDJSON
+)
+
+// Run the pipeline over log files, or stdin, without an HTTP server and
+// print the discovered templates and anomalies
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	config := configFlags(fs)
+	format := fs.String("format", formatAuto, "input format: auto, raw, json or ndjson")
+	minSeverity := fs.String("min-severity", anomaly.SeverityMedium.String(), "lowest anomaly severity to report")
+	verbose := fs.Bool("v", false, "log pipeline debug output to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s analyze [flags] [file ...]\n\nReads stdin if no file, or -, is given.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg := config()
+	cfg.Offline = true
+
+	minSev, err := anomaly.ParseSeverity(*minSeverity)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *verbose {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	} else {
+		slog.SetLogLoggerLevel(slog.LevelWarn)
+	}
+
+	// Keep everything in memory unless a DB was asked for
+	dbSet := false
+	fs.Visit(func(f *flag.Flag) { dbSet = dbSet || f.Name == "db" })
+	if !dbSet {
+		cfg.DatabaseFile = ""
+	}
+
+	s, err := server.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start pipeline: %s", err)
+	}
+	defer s.Close()
+
+	// Keep the most severe anomaly per type and template
+	found := make(map[alert.BufferKey]anomaly.Anomaly)
+	var order []alert.BufferKey
+	collect := func(as []anomaly.Anomaly) {
+		for _, a := range as {
+			if a.Severity < minSev {
+				continue
+			}
+			k := alert.BufferKey{AnomalyType: a.Type, TemplateID: a.TemplateID}
+			prev, ok := found[k]
+			if !ok {
+				order = append(order, k)
+			}
+			if !ok || a.Severity > prev.Severity {
+				found[k] = a
+			}
+		}
+	}
+	process := func(le common.LogEvent) {
+		collect(s.Process(le))
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	events, rejected := 0, 0
+	for _, name := range files {
+		n, r, err := analyzeFile(name, *format, process)
+		events += n
+		rejected += r
+		if err != nil {
+			log.Fatalf("Failed to read %s: %s", name, err)
+		}
+	}
+	collect(s.Flush())
+
+	counts, err := s.TemplateCounts()
+	if err != nil {
+		log.Fatalf("Failed to get templates: %s", err)
+	}
+
+	fmt.Printf("Processed %d events (%d rejected), %d templates\n\n", events, rejected, len(counts))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if cfg.TemplateScope.IsGlobal() {
+		fmt.Fprintln(tw, "COUNT\tTEMPLATE ID\tTEMPLATE")
+		for _, tc := range counts {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", tc.TotalCount, tc.TemplateID, tc.Text)
+		}
+		tw.Flush()
+	} else {
+		fmt.Fprintln(tw, "COUNT\tTEMPLATE ID\tSCOPE\tTEMPLATE")
+		for _, tc := range counts {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", tc.TotalCount, tc.TemplateID, tc.Scope, tc.Text)
+		}
+		tw.Flush()
+
+		totals, err := s.CrossScopeCounts()
+		if err != nil {
+			log.Fatalf("Failed to get cross-scope counts: %s", err)
+		}
+		fmt.Printf("\nAcross scopes\n")
+		fmt.Fprintln(tw, "COUNT\tSCOPES\tTEMPLATE")
+		for _, cc := range totals {
+			fmt.Fprintf(tw, "%d\t%d\t%s\n", cc.TotalCount, cc.ScopeCount, cc.Text)
+		}
+		tw.Flush()
+	}
+
+	anomalies := make([]anomaly.Anomaly, 0, len(order))
+	for _, k := range order {
+		anomalies = append(anomalies, found[k])
+	}
+	fmt.Printf("\n%d anomalies\n", len(anomalies))
+	alert.StdoutTarget{}.Alert(anomalies)
+}
+
+// Feed every log event of the named file, or stdin for "-", to process.
+// Returns the number of events processed and rejected
+func analyzeFile(name string, format string, process func(common.LogEvent)) (int, int, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	if format == formatAuto {
+		format = detectFormat(br)
+	}
+
+	decoded := func(le common.LogEvent, _ int) error {
+		process(le)
+		return nil
+	}
+	switch format {
+	case formatRaw:
+		return readRaw(br, process)
+	case formatJSON:
+		return ingest.DecodeJSONArray(br, decoded)
+	case formatNDJSON:
+		return ingest.DecodeNDJSON(br, decoded)
+	default:
+		return 0, 0, fmt.Errorf("unknown input format %q", format)
+	}
+}
+
+// Guess the input format from the first non-space character, input that
+// doesn't start like JSON is read as raw lines
+func detectFormat(br *bufio.Reader) string {
+	if c, ok := ingest.PeekNonSpace(br); !ok || (c != '[' && c != '{') {
+		return formatRaw
+	}
+	return ingest.DetectJSONFormat(br)
+}
+
+func readRaw(r io.Reader, process func(common.LogEvent)) (int, int, error) {
+	n := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), ingest.MaxLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		process(rawEvent(line))
+		n++
+	}
+	return n, 0, scanner.Err()
+}
+
+// Build a log event from a raw line, using the leading timestamp written by
+// `kubectl logs --timestamps` as the event time if present
+func rawEvent(line string) common.LogEvent {
+	le := common.LogEvent{Log: line}
+	prefix, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return le
+	}
+	ts, err := time.Parse(time.RFC3339Nano, prefix)
+	if err != nil {
+		return le
+	}
+	le.Log = rest
+	le.Time = ts
+	return le
+}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log-analyzer/internal/anomaly"
+	"log-analyzer/internal/common"
+	"log-analyzer/internal/forward"
 	server "log-analyzer/internal/server"
+	"log-analyzer/internal/syslog"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func setupLogging() {
@@ -12,15 +24,198 @@ func setupLogging() {
 	// slog.SetLogLoggerLevel(slog.LevelInfo)
 }
 
+// Register pipeline flags shared by all subcommands on fs.
+// The returned function must be called after fs is parsed.
+func configFlags(fs *flag.FlagSet) func() server.Config {
+	cfg := server.DefaultConfig()
+
+	fs.StringVar(&cfg.DatabaseFile, "db", cfg.DatabaseFile, "template database file, empty to keep templates in memory only")
+	fs.StringVar(&cfg.RulesFile, "rules", cfg.RulesFile, "YAML or JSON file with custom masking rules")
+	fs.Float64Var(&cfg.TemplateSimilarity, "similarity", cfg.TemplateSimilarity,
+		"min share of matching tokens, between 0 and 1, for a log line to join an existing template")
+	fs.IntVar(&cfg.TemplateMergeDistance, "merge-distance", cfg.TemplateMergeDistance,
+		"max differing tokens for near-identical templates to be merged into a wildcard template, 0 disables merging")
+	scope := fs.String("template-scope", cfg.TemplateScope.String(),
+		"partition templates by workload: global, namespace, namespace+container or label:<key>")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", cfg.MaxBodyBytes,
+		"reject ingest request bodies and forward messages larger than this many bytes once decompressed, 0 for no limit")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout,
+		"on SIGINT or SIGTERM, give up draining ingest and flushing alerts after this long")
+	fs.DurationVar(&cfg.StatsFlushInterval, "stats-flush-interval", cfg.StatsFlushInterval,
+		"write template counters to the DB this often, counters changed since the last write are lost on a crash")
+	fs.DurationVar(&cfg.CompactInterval, "compact-interval", cfg.CompactInterval,
+		"roll hourly counts past the lookback window up into daily counts and fold transitions of gone pods this often, 0 to disable")
+	fs.DurationVar(&cfg.DailyCountsRetention, "daily-counts-retention", cfg.DailyCountsRetention,
+		"drop daily counts older than this, 0 to keep them forever")
+	fs.DurationVar(&cfg.GonePodRetention, "gone-pod-retention", cfg.GonePodRetention,
+		"fold the transitions of pods not seen for this long into their namespace and container, 0 to keep them")
+	fs.DurationVar(&cfg.CheckpointInterval, "checkpoint-interval", cfg.CheckpointInterval,
+		"checkpoint the DB write-ahead log this often, 0 to disable")
+	fs.DurationVar(&cfg.VacuumInterval, "vacuum-interval", cfg.VacuumInterval,
+		"VACUUM the DB this often to release the space of deleted rows, 0 to disable")
+	fs.IntVar(&cfg.QueueSize, "queue-size", cfg.QueueSize,
+		"max log events waiting to be processed, receivers are turned away or held back once it is full")
+	fs.IntVar(&cfg.QueueWorkers, "queue-workers", cfg.QueueWorkers, "number of workers processing queued log events")
+	fs.StringVar(&cfg.ForwardAddr, "forward-addr", cfg.ForwardAddr, "Fluent Forward listen address, empty to disable")
+	fs.StringVar(&cfg.SyslogUDPAddr, "syslog-udp-addr", cfg.SyslogUDPAddr, "syslog UDP listen address, empty to disable")
+	fs.StringVar(&cfg.SyslogTCPAddr, "syslog-tcp-addr", cfg.SyslogTCPAddr, "syslog TCP listen address, empty to disable")
+	fs.StringVar(&cfg.SyslogTLSAddr, "syslog-tls-addr", cfg.SyslogTLSAddr, "syslog TLS listen address, empty to disable")
+	fs.StringVar(&cfg.SyslogTLSCert, "syslog-tls-cert", cfg.SyslogTLSCert, "PEM certificate file of the syslog TLS listener")
+	fs.StringVar(&cfg.SyslogTLSKey, "syslog-tls-key", cfg.SyslogTLSKey, "PEM key file of the syslog TLS listener")
+	syslogTZ := fs.String("syslog-timezone", cfg.SyslogLocation.String(),
+		"IANA time zone of RFC 3164 syslog timestamps, which carry none, Local for the zone of this host")
+	fs.DurationVar(&cfg.PartialTimeout, "partial-timeout", cfg.PartialTimeout,
+		"release a CRI partial line without its final record after this long")
+	fs.IntVar(&cfg.PartialMaxBytes, "partial-max-bytes", cfg.PartialMaxBytes,
+		"cut reassembled CRI partial lines at this many bytes")
+	fs.DurationVar(&cfg.MultilineTimeout, "multiline-timeout", cfg.MultilineTimeout,
+		"release a stack trace after this long without a new line")
+	fs.IntVar(&cfg.MultilineMaxLines, "multiline-max-lines", cfg.MultilineMaxLines,
+		"release a stack trace once it reaches this many lines")
+	latePolicy := fs.String("late-policy", cfg.LatePolicy.String(),
+		"policy for events older than the watermark by more than -max-lateness: accept, clamp or drop")
+	fs.DurationVar(&cfg.MaxLateness, "max-lateness", cfg.MaxLateness,
+		"how far behind the newest event time an event may arrive before it is considered late")
+	fs.DurationVar(&cfg.MaxClockSkew, "max-clock-skew", cfg.MaxClockSkew,
+		"events stamped further than this in the future are accounted at the current time")
+	fs.DurationVar(&cfg.NewTemplateGracePeriod, "new-template-grace", cfg.NewTemplateGracePeriod,
+		"do not report new templates for this long after startup or after a workload is deployed")
+	newTmplSev := fs.String("new-template-severity", cfg.NewTemplateSeverity.String(),
+		"severity of new template anomalies")
+	newTmplErrSev := fs.String("new-template-error-severity", cfg.NewTemplateErrorSeverity.String(),
+		"severity of new template anomalies for error or fatal log lines")
+	fs.DurationVar(&cfg.NewTemplateResolveAfter, "new-template-resolve", cfg.NewTemplateResolveAfter,
+		"resolve new template anomalies this long after they were raised")
+
+	return func() server.Config {
+		lp, err := common.ParseLatePolicy(*latePolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.LatePolicy = lp
+
+		if cfg.TemplateScope, err = common.ParseTemplateScope(*scope); err != nil {
+			log.Fatal(err)
+		}
+
+		if cfg.SyslogLocation, err = time.LoadLocation(*syslogTZ); err != nil {
+			log.Fatal(err)
+		}
+
+		if cfg.NewTemplateSeverity, err = anomaly.ParseSeverity(*newTmplSev); err != nil {
+			log.Fatal(err)
+		}
+		if cfg.NewTemplateErrorSeverity, err = anomaly.ParseSeverity(*newTmplErrSev); err != nil {
+			log.Fatal(err)
+		}
+
+		if cfg.StatsFlushInterval <= 0 {
+			log.Fatal("stats flush interval must be positive")
+		}
+		return cfg
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "serve":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
 	setupLogging()
+	config := configFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [serve] [flags]\n       %s analyze [flags] [file ...]\n       %s migrate [flags]\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cfg := config()
+
+	// Cancelled on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	s, err := server.NewServer()
+	s, err := server.NewServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to start server: %s", err)
 	}
+
+	var fl *forward.Listener
+	if cfg.ForwardAddr != "" {
+		fl = forward.NewListener(cfg.ForwardAddr, cfg.MaxBodyBytes, s.SubmitWait)
+		go func() {
+			if err := fl.ListenAndServe(); err != nil {
+				log.Fatalf("Failed to start forward listener: %s", err)
+			}
+		}()
+	}
+
+	sl := syslog.NewListener(func(le common.LogEvent) {
+		s.SubmitWait([]common.LogEvent{le})
+	})
+	sl.Location = cfg.SyslogLocation
+	if cfg.SyslogUDPAddr != "" {
+		go func() {
+			if err := sl.ListenAndServeUDP(cfg.SyslogUDPAddr); err != nil {
+				log.Fatalf("Failed to start syslog UDP listener: %s", err)
+			}
+		}()
+	}
+	if cfg.SyslogTCPAddr != "" {
+		go func() {
+			if err := sl.ListenAndServeTCP(cfg.SyslogTCPAddr); err != nil {
+				log.Fatalf("Failed to start syslog TCP listener: %s", err)
+			}
+		}()
+	}
+	if cfg.SyslogTLSAddr != "" {
+		go func() {
+			if err := sl.ListenAndServeTLS(cfg.SyslogTLSAddr, cfg.SyslogTLSCert, cfg.SyslogTLSKey); err != nil {
+				log.Fatalf("Failed to start syslog TLS listener: %s", err)
+			}
+		}()
+	}
+
 	http.HandleFunc("/ingest", s.Ingest)
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatal(err)
+	http.HandleFunc("/v1/logs", s.OTLPLogs)
+	http.HandleFunc("/loki/api/v1/push", s.LokiPush)
+	http.HandleFunc("POST /_bulk", s.ElasticBulk)
+	http.HandleFunc("POST /{index}/_bulk", s.ElasticBulk)
+	http.HandleFunc("GET /{$}", s.ElasticInfo)
+	http.HandleFunc("GET /metrics", s.Metrics)
+	hs := &http.Server{Addr: ":8080"}
+	go func() {
+		if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info(fmt.Sprintf("Shutting down, waiting up to %s", cfg.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop the receivers first, so everything they accepted is processed
+	if err := hs.Shutdown(shutdownCtx); err != nil {
+		slog.Error(fmt.Sprintf("Failed to drain HTTP requests: %s", err))
+	}
+	if fl != nil {
+		fl.Close()
+	}
+	sl.Close()
+
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		slog.Error(fmt.Sprintf("Unclean shutdown: %s", err))
+		os.Exit(1)
 	}
+	slog.Info("Shutdown complete")
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log-analyzer/internal/db"
+	server "log-analyzer/internal/server"
+	"os"
+)
+
+// Migrate the template DB to the latest schema version without starting
+// the server
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbFile := fs.String("db", server.DefaultConfig().DatabaseFile, "template database file")
+	dryRun := fs.Bool("dry-run", false, "only list the migrations that would be applied")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	version, migrations, err := db.Migrate(*dbFile, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to migrate %s: %s", *dbFile, err)
+	}
+
+	fmt.Printf("%s is at schema version %d\n", *dbFile, version)
+	if len(migrations) == 0 {
+		fmt.Println("Schema is up to date")
+		return
+	}
+
+	verb := "Applied"
+	if *dryRun {
+		verb = "Would apply"
+	}
+	for _, m := range migrations {
+		fmt.Printf("%s %04d %s\n", verb, m.Version, m.Name)
+	}
+}
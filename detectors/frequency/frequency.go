@@ -14,11 +14,16 @@ const (
 	sweepInterval = 5 * time.Second
 )
 
+// Detects templates counted far more often than usual for the hour.
+// Hours without a count are given a zero row on a ticker, at the event time
+// of Clock, so they take part in the baseline.
 type FrequencyDetector struct {
-	tdb *db.TemplateDB
+	Clock *common.EventClock
+
+	tdb db.Store
 }
 
-func (fd *FrequencyDetector) Init(tdb *db.TemplateDB) error {
+func (fd *FrequencyDetector) Init(tdb db.Store) error {
 	fd.tdb = tdb
 	return nil
 }
@@ -30,7 +35,11 @@ func (fd FrequencyDetector) Start(done <-chan bool) error {
 		for {
 			select {
 			case <-ticker.C:
-				err := fd.sweep()
+				now := fd.Clock.Now()
+				if now.IsZero() {
+					continue // no events yet
+				}
+				err := fd.sweep(now)
 				if err != nil {
 					slog.Error(fmt.Sprintf("hourly stats check failed: %s", err))
 				}
@@ -44,18 +53,18 @@ func (fd FrequencyDetector) Start(done <-chan bool) error {
 }
 
 func (fd FrequencyDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, error) {
-	mean, stddev, err := fd.tdb.GetHourlyStats(tmpl.ID)
+	mean, stddev, err := fd.tdb.GetHourlyStats(tmpl.ID, tmpl.Timestamp)
 	if err != nil {
 		return nil, err
 	}
 
-	count, err := fd.tdb.GetCurrHourlyCount(tmpl.ID)
+	count, err := fd.tdb.GetHourlyCount(tmpl.ID, tmpl.Timestamp)
 	if err != nil {
 		return nil, err
 	}
 
 	// Scaled-hour variance (simple heuristic)
-	minutes_elapsed := float64(time.Now().Minute()) / 60
+	minutes_elapsed := float64(tmpl.Timestamp.Minute()) / 60
 	expected_partial := mean * minutes_elapsed
 	var_partial := math.Pow(stddev, 2) * minutes_elapsed
 	std_partial := math.Sqrt(var_partial)
@@ -68,7 +77,7 @@ func (fd FrequencyDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, erro
 	slog.Debug(fmt.Sprintf("Template: %s | Frequency Z score: %f", tmpl.ID, z))
 
 	sev := anomaly.SeverityFromZScore(z)
-	a := anomaly.Anomaly{TemplateID: tmpl.ID, Type: anomaly.AnomalyTypeFrequency, Severity: sev, Timestamp: time.Now()}
+	a := anomaly.Anomaly{TemplateID: tmpl.ID, Type: anomaly.AnomalyTypeFrequency, Severity: sev, Timestamp: tmpl.Timestamp}
 	if sev > anomaly.SeverityInfo {
 		a.Description = fmt.Sprintf(
 			"abnormal frequency spike detected for template %s: Frequency deviates significantly from baseline (Z = %f)",
@@ -79,7 +88,7 @@ func (fd FrequencyDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, erro
 	return []anomaly.Anomaly{a}, nil
 }
 
-func (fd FrequencyDetector) sweep() error {
+func (fd FrequencyDetector) sweep(now time.Time) error {
 	allTemplates, err := fd.tdb.GetAllTemplates()
 	if err != nil {
 		return fmt.Errorf("failed to get all templates: %s", err)
@@ -89,7 +98,7 @@ func (fd FrequencyDetector) sweep() error {
 
 	for _, c := range allTemplates {
 		for _, tmpl := range c {
-			err := fd.tdb.InsertHourlyRow(tmpl.ID)
+			err := fd.tdb.InsertHourlyRow(tmpl.ID, now)
 			if err != nil {
 				slog.Warn(fmt.Sprintf("Could not update hourly stats for template %s", tmpl.ID))
 			}
@@ -0,0 +1,179 @@
+package newtemplate
+
+import (
+	"errors"
+	"fmt"
+	"log-analyzer/internal/anomaly"
+	"log-analyzer/internal/common"
+	"log-analyzer/internal/db"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSeverity      = anomaly.SeverityMedium
+	defaultErrorSeverity = anomaly.SeverityHigh
+	defaultResolveAfter  = time.Hour
+	resolveInterval      = 30 * time.Second
+)
+
+// Detects templates that have never been counted before.
+// New templates are expected right after startup and right after a workload
+// is (re)deployed, so they are only reported once GracePeriod has passed
+// since either. Both are measured in event time, startup being the first
+// event checked.
+// A new template is only new once, so seeing it again doesn't resolve its
+// alert. Alerts are resolved on a ticker instead, once ResolveAfter has
+// passed since they were raised at the event time of Clock.
+type NewTemplateDetector struct {
+	GracePeriod   time.Duration
+	Severity      anomaly.Severity // severity of new templates
+	ErrorSeverity anomaly.Severity // severity of new templates with an error or fatal level
+	ResolveAfter  time.Duration
+	Clock         *common.EventClock
+
+	tdb  db.Store
+	emit func([]anomaly.Anomaly)
+
+	deploymentsMu sync.Mutex
+	startedAt     time.Time             // event time of the first event checked
+	deployments   map[string]deployment // workload key to its current deployment
+
+	pendingMu sync.Mutex
+	pending   map[string]anomaly.Anomaly // template IDs to their unresolved alerts
+}
+
+type deployment struct {
+	image     string
+	firstSeen time.Time // event time of the first log of this image
+}
+
+func (nd *NewTemplateDetector) Init(tdb db.Store) error {
+	nd.tdb = tdb
+	nd.deployments = make(map[string]deployment)
+	nd.pending = make(map[string]anomaly.Anomaly)
+
+	if nd.Severity == anomaly.SeverityResolved {
+		nd.Severity = defaultSeverity
+	}
+	if nd.ErrorSeverity == anomaly.SeverityResolved {
+		nd.ErrorSeverity = defaultErrorSeverity
+	}
+	if nd.ResolveAfter <= 0 {
+		nd.ResolveAfter = defaultResolveAfter
+	}
+	return nil
+}
+
+func (nd *NewTemplateDetector) SetEmitter(emit func([]anomaly.Anomaly)) {
+	nd.emit = emit
+}
+
+func (nd *NewTemplateDetector) Start(done <-chan bool) error {
+	ticker := time.NewTicker(resolveInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := nd.Clock.Now()
+				if now.IsZero() {
+					continue // no events yet
+				}
+				if resolved := nd.resolve(now); len(resolved) > 0 && nd.emit != nil {
+					nd.emit(resolved)
+				}
+			case <-done:
+				fmt.Println("Stopping new template resolve scheduler...")
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (nd *NewTemplateDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, error) {
+	startedAt, deployedAt := nd.observeDeployment(tmpl)
+
+	// Templates are counted after detectors run, so a template without
+	// stats has never been seen before
+	_, _, _, _, err := nd.tdb.GetIATStats(tmpl.ID)
+	if err == nil {
+		return []anomaly.Anomaly{}, nil
+	}
+	if !errors.Is(err, db.ErrNotCounted) {
+		return []anomaly.Anomaly{}, fmt.Errorf("failed to get template stats: %s", err)
+	}
+
+	if tmpl.Timestamp.Sub(startedAt) < nd.GracePeriod {
+		slog.Debug(fmt.Sprintf("Template: %s | New template within startup grace period", tmpl.ID))
+		return []anomaly.Anomaly{}, nil
+	}
+	if tmpl.Timestamp.Sub(deployedAt) < nd.GracePeriod {
+		slog.Debug(fmt.Sprintf("Template: %s | New template within deployment grace period of %s", tmpl.ID, tmpl.K8sMetadata.Workload()))
+		return []anomaly.Anomaly{}, nil
+	}
+
+	sev := nd.Severity
+	if tmpl.IsError() {
+		sev = nd.ErrorSeverity
+	}
+
+	a := anomaly.Anomaly{
+		TemplateID: tmpl.ID,
+		Type:       anomaly.AnomalyTypeNewTemplate,
+		Severity:   sev,
+		Timestamp:  tmpl.Timestamp,
+		Description: fmt.Sprintf(
+			"new template %s: %q (sample: %q)",
+			tmpl.ID, strings.Join(tmpl.Tokens, " "), tmpl.Sample,
+		),
+	}
+
+	nd.pendingMu.Lock()
+	nd.pending[tmpl.ID] = a
+	nd.pendingMu.Unlock()
+	return []anomaly.Anomaly{a}, nil
+}
+
+// Resolve the alerts raised ResolveAfter or longer before now, keeping
+// their description
+func (nd *NewTemplateDetector) resolve(now time.Time) []anomaly.Anomaly {
+	nd.pendingMu.Lock()
+	defer nd.pendingMu.Unlock()
+
+	resolved := []anomaly.Anomaly{}
+	for id, a := range nd.pending {
+		if now.Sub(a.Timestamp) < nd.ResolveAfter {
+			continue
+		}
+		delete(nd.pending, id)
+		slog.Debug(fmt.Sprintf("Template: %s | New template resolved", id))
+		a.Severity = anomaly.SeverityInfo
+		resolved = append(resolved, a)
+	}
+	return resolved
+}
+
+// Record the container image the template's workload runs and return the
+// event time of startup and of its current deployment being first seen
+func (nd *NewTemplateDetector) observeDeployment(tmpl common.Template) (time.Time, time.Time) {
+	meta := tmpl.K8sMetadata
+	key := meta.Namespace + "/" + meta.ContainerName
+
+	nd.deploymentsMu.Lock()
+	defer nd.deploymentsMu.Unlock()
+
+	if nd.startedAt.IsZero() {
+		nd.startedAt = tmpl.Timestamp
+	}
+
+	d, ok := nd.deployments[key]
+	if !ok || d.image != meta.ContainerImg {
+		d = deployment{image: meta.ContainerImg, firstSeen: tmpl.Timestamp}
+		nd.deployments[key] = d
+	}
+	return nd.startedAt, d.firstSeen
+}
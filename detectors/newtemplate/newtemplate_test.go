@@ -0,0 +1,76 @@
+package newtemplate
+
+import (
+	"log-analyzer/internal/alert"
+	"log-analyzer/internal/anomaly"
+	"log-analyzer/internal/common"
+	"log-analyzer/internal/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTemplate(t *testing.T) {
+	t0 := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+	store := db.NewMemoryStore()
+	defer store.Close()
+
+	nd := &NewTemplateDetector{ResolveAfter: time.Hour}
+	if err := nd.Init(store); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := common.Template{
+		ID:          "a",
+		K8sMetadata: common.K8sMetadata{Namespace: "shop", ContainerName: "api", ContainerImg: "api:1"},
+		Tokens:      []string{"cache", "miss", "<NUM>"},
+		Sample:      "cache miss 42",
+	}
+	buffer := alert.AnomalyBuffer{}
+	check := func(ts time.Time) {
+		t.Helper()
+		tmpl.Timestamp = ts
+		anomalies, err := nd.Check(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range anomalies {
+			buffer.Add(a)
+		}
+		// Templates are counted after detectors run
+		if err := store.CountTemplate(tmpl.ID, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The template is seen twice before the buffer is flushed
+	check(t0)
+	check(t0.Add(time.Second))
+
+	flushed := buffer.Flush()
+	if len(flushed) != 1 {
+		t.Fatalf("got %d anomalies, want the new template alert: %+v", len(flushed), flushed)
+	}
+	a := flushed[0]
+	if a.Type != anomaly.AnomalyTypeNewTemplate || a.Severity != defaultSeverity || !strings.Contains(a.Description, "cache miss 42") {
+		t.Fatalf("got anomaly %+v, want a %s new template alert with its sample", a, defaultSeverity)
+	}
+
+	if resolved := nd.resolve(t0.Add(59 * time.Minute)); len(resolved) != 0 {
+		t.Fatalf("got %+v resolved before ResolveAfter, want none", resolved)
+	}
+	resolved := nd.resolve(t0.Add(time.Hour))
+	if len(resolved) != 1 {
+		t.Fatalf("got %d anomalies resolved after ResolveAfter, want 1", len(resolved))
+	}
+	for _, r := range resolved {
+		buffer.Add(r)
+	}
+	flushed = buffer.Flush()
+	if len(flushed) != 1 || flushed[0].Severity != anomaly.SeverityResolved || flushed[0].Description != a.Description {
+		t.Fatalf("got %+v, want the new template alert resolved with its description", flushed)
+	}
+	if resolved := nd.resolve(t0.Add(2 * time.Hour)); len(resolved) != 0 {
+		t.Fatalf("got %+v resolved again, want none", resolved)
+	}
+}
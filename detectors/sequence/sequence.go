@@ -6,7 +6,6 @@ import (
 	"log-analyzer/internal/common"
 	"log-analyzer/internal/db"
 	"log/slog"
-	"time"
 )
 
 const (
@@ -15,10 +14,10 @@ const (
 )
 
 type SequenceDetector struct {
-	tdb *db.TemplateDB
+	tdb db.Store
 }
 
-func (sd *SequenceDetector) Init(tdb *db.TemplateDB) error {
+func (sd *SequenceDetector) Init(tdb db.Store) error {
 	sd.tdb = tdb
 	return nil
 }
@@ -28,13 +27,13 @@ func (sd SequenceDetector) Start(done <-chan bool) error {
 }
 
 func (sd SequenceDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, error) {
-	total, tran, err := sd.tdb.GetTransitionCounts(tmpl.ID, tmpl.K8sMetadata.PodID)
+	total, tran, err := sd.tdb.GetTransitionCounts(tmpl.ID, tmpl.K8sMetadata)
 	if err != nil {
 		return nil, err
 	}
 
 	sev := anomaly.SeverityInfo
-	a := anomaly.Anomaly{TemplateID: tmpl.ID, Type: anomaly.AnomalyTypeSequence, Severity: sev, Timestamp: time.Now()}
+	a := anomaly.Anomaly{TemplateID: tmpl.ID, Type: anomaly.AnomalyTypeSequence, Severity: sev, Timestamp: tmpl.Timestamp}
 
 	// Skip check if not enough total transitions recorded
 	if total < warmupThreshold {
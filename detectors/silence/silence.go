@@ -0,0 +1,150 @@
+package silence
+
+import (
+	"fmt"
+	"log-analyzer/internal/anomaly"
+	"log-analyzer/internal/common"
+	"log-analyzer/internal/db"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	sweepInterval   = 30 * time.Second
+	warmupThreshold = 10
+	timingCVFilter  = 0.6 // stddev / mean threshold, only regular templates can go silent
+	minSilenceRatio = 3.0 // silence must also be this many times the mean IAT
+)
+
+// Detects periodic templates that stopped appearing.
+// Silence can't be observed from Check since the template never arrives, so
+// templates are swept on a ticker and anomalies are emitted directly.
+// Sweeps run at the event time of Clock, like the templates' last seen
+// times, so replaying a backlog doesn't make every template look silent.
+type SilenceDetector struct {
+	Clock *common.EventClock
+
+	tdb  db.Store
+	emit func([]anomaly.Anomaly)
+
+	mu       sync.Mutex
+	lastMeta map[string]common.K8sMetadata // template ID to workload it was last seen in
+	silent   map[string]bool               // template IDs currently reported as silent
+}
+
+func (sd *SilenceDetector) Init(tdb db.Store) error {
+	sd.tdb = tdb
+	sd.lastMeta = make(map[string]common.K8sMetadata)
+	sd.silent = make(map[string]bool)
+	return nil
+}
+
+func (sd *SilenceDetector) SetEmitter(emit func([]anomaly.Anomaly)) {
+	sd.emit = emit
+}
+
+func (sd *SilenceDetector) Start(done <-chan bool) error {
+	ticker := time.NewTicker(sweepInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := sd.Clock.Now()
+				if now.IsZero() {
+					continue // no events yet
+				}
+				err := sd.sweep(now)
+				if err != nil {
+					slog.Error(fmt.Sprintf("silence check failed: %s", err))
+				}
+			case <-done:
+				fmt.Println("Stopping silence sweep scheduler...")
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// A silent template showing up again resolves its anomaly
+func (sd *SilenceDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.lastMeta[tmpl.ID] = tmpl.K8sMetadata
+	if !sd.silent[tmpl.ID] {
+		return []anomaly.Anomaly{}, nil
+	}
+
+	delete(sd.silent, tmpl.ID)
+	slog.Debug(fmt.Sprintf("Template: %s | Silence resolved", tmpl.ID))
+	a := anomaly.Anomaly{TemplateID: tmpl.ID, Type: anomaly.AnomalyTypeSilence, Severity: anomaly.SeverityInfo, Timestamp: tmpl.Timestamp}
+	return []anomaly.Anomaly{a}, nil
+}
+
+func (sd *SilenceDetector) sweep(now time.Time) error {
+	stats, err := sd.tdb.GetAllTemplateStats()
+	if err != nil {
+		return fmt.Errorf("failed to get template stats: %s", err)
+	}
+
+	anomalies := []anomaly.Anomaly{}
+	sd.mu.Lock()
+	for _, st := range stats {
+		a, ok := sd.checkSilence(st, now)
+		if !ok {
+			continue
+		}
+		sd.silent[st.TemplateID] = true
+		a.K8sMetadata = sd.lastMeta[st.TemplateID]
+		anomalies = append(anomalies, a)
+	}
+	sd.mu.Unlock()
+
+	if len(anomalies) > 0 && sd.emit != nil {
+		sd.emit(anomalies)
+	}
+	return nil
+}
+
+// Return a silence anomaly if the template has been quiet far longer than
+// its usual inter-arrival time
+func (sd *SilenceDetector) checkSilence(st db.TemplateStats, now time.Time) (anomaly.Anomaly, bool) {
+	// Not enough data, or the template isn't regular enough to expect it
+	if st.TotalCount < warmupThreshold || st.IATMean <= 0 || st.IATStddev == 0 {
+		return anomaly.Anomaly{}, false
+	}
+	if st.IATStddev/st.IATMean > timingCVFilter {
+		return anomaly.Anomaly{}, false
+	}
+
+	silence := now.Sub(st.LastSeen).Seconds()
+	if silence < st.IATMean*minSilenceRatio {
+		return anomaly.Anomaly{}, false
+	}
+
+	z := (silence - st.IATMean) / st.IATStddev
+	slog.Debug(fmt.Sprintf("Template: %s | Silence Z score: %f", st.TemplateID, z))
+
+	sev := anomaly.SeverityFromZScore(z)
+	if sev <= anomaly.SeverityInfo {
+		return anomaly.Anomaly{}, false
+	}
+
+	a := anomaly.Anomaly{
+		TemplateID: st.TemplateID,
+		Type:       anomaly.AnomalyTypeSilence,
+		Severity:   sev,
+		Timestamp:  st.LastSeen,
+		Description: fmt.Sprintf(
+			"template %s stopped appearing: silent for %s, usually every %s (Z = %f)",
+			st.TemplateID,
+			time.Duration(silence*float64(time.Second)).Round(time.Second),
+			time.Duration(st.IATMean*float64(time.Second)).Round(time.Second),
+			z,
+		),
+	}
+	return a, true
+}
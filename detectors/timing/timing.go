@@ -1,7 +1,6 @@
 package timing
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"log-analyzer/internal/anomaly"
@@ -17,10 +16,10 @@ const (
 )
 
 type TimingDetector struct {
-	tdb *db.TemplateDB
+	tdb db.Store
 }
 
-func (td *TimingDetector) Init(tdb *db.TemplateDB) error {
+func (td *TimingDetector) Init(tdb db.Store) error {
 	td.tdb = tdb
 	return nil
 }
@@ -32,7 +31,7 @@ func (td TimingDetector) Start(done <-chan bool) error {
 func (td TimingDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, error) {
 	count, mean, stddev, ts, err := td.tdb.GetIATStats(tmpl.ID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, db.ErrNotCounted) {
 			return []anomaly.Anomaly{}, nil
 		}
 		return []anomaly.Anomaly{}, fmt.Errorf("failed to get IAT Stats: %s", err)
@@ -53,13 +52,13 @@ func (td TimingDetector) Check(tmpl common.Template) ([]anomaly.Anomaly, error)
 		return []anomaly.Anomaly{}, fmt.Errorf("failed to parse timestamp: %s", err)
 	}
 
-	iat := time.Since(lastTs).Seconds()
+	iat := tmpl.Timestamp.Sub(lastTs).Seconds()
 	z := (iat - mean) / stddev
 
 	slog.Debug(fmt.Sprintf("Template: %s | Timing Z score: %f", tmpl.ID, z))
 
 	sev := anomaly.SeverityFromZScore(z)
-	a := anomaly.Anomaly{TemplateID: tmpl.ID, Type: anomaly.AnomalyTypeTiming, Severity: sev, Timestamp: time.Now()}
+	a := anomaly.Anomaly{TemplateID: tmpl.ID, Type: anomaly.AnomalyTypeTiming, Severity: sev, Timestamp: tmpl.Timestamp}
 	if sev > anomaly.SeverityInfo {
 		a.Description = fmt.Sprintf(
 			"Abnormal latency detected for template %s: IAT deviates significantly from baseline (Z = %f)",
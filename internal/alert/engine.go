@@ -3,6 +3,7 @@ package alert
 import (
 	"fmt"
 	"log-analyzer/internal/anomaly"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,8 @@ func NewAlertEngine() *AlertEngine {
 type AlertEngine struct {
 	alertTargets []AlertTarget
 	buffer       AnomalyBuffer
+	bufferMu     sync.Mutex // anomalies are added from ingest and detector goroutines
+	wg           sync.WaitGroup
 }
 
 func (ae *AlertEngine) AddAlertTarget(at AlertTarget) {
@@ -26,11 +29,19 @@ func (ae *AlertEngine) AddAlertTarget(at AlertTarget) {
 }
 
 func (ae *AlertEngine) AddAnomalies(as []anomaly.Anomaly) {
+	ae.bufferMu.Lock()
+	defer ae.bufferMu.Unlock()
 	for _, a := range as {
 		ae.buffer.Add(a)
 	}
 }
 
+func (ae *AlertEngine) flushBuffer() []anomaly.Anomaly {
+	ae.bufferMu.Lock()
+	defer ae.bufferMu.Unlock()
+	return ae.buffer.Flush()
+}
+
 func (ae *AlertEngine) Start(interval time.Duration, done <-chan bool) {
 	ticker := time.NewTicker(interval)
 
@@ -40,16 +51,18 @@ func (ae *AlertEngine) Start(interval time.Duration, done <-chan bool) {
 		}
 	}
 
+	ae.wg.Add(1)
 	go func() {
+		defer ae.wg.Done()
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				anomalies := ae.buffer.Flush()
+				anomalies := ae.flushBuffer()
 				sendAlerts(anomalies)
 			case <-done:
 				fmt.Println("Stopping flush scheduler...")
-				anomalies := ae.buffer.Flush() // Final flush before stopping
+				anomalies := ae.flushBuffer() // Final flush before stopping
 				sendAlerts(anomalies)
 				return
 			}
@@ -57,3 +70,9 @@ func (ae *AlertEngine) Start(interval time.Duration, done <-chan bool) {
 
 	}()
 }
+
+// Wait for the flush scheduler to stop, after its final flush, once done is
+// closed
+func (ae *AlertEngine) Wait() {
+	ae.wg.Wait()
+}
@@ -9,7 +9,11 @@ type StdoutTarget struct{}
 
 func (st StdoutTarget) Alert(anomalies []anomaly.Anomaly) (ok bool) {
 	for _, a := range anomalies {
-		fmt.Printf("stdout alert: %s | Type %s | Template %s | Since: %s | %s\n", a.Severity, a.Type, a.TemplateID, a.Timestamp.Format("2006-01-02 15:04:05"), a.Description)
+		trace := ""
+		if a.TraceID != "" {
+			trace = " | Trace " + a.TraceID
+		}
+		fmt.Printf("stdout alert: %s | Type %s | Template %s | Workload %s%s | Since: %s | %s\n", a.Severity, a.Type, a.TemplateID, a.K8sMetadata.Workload(), trace, a.Timestamp.Format("2006-01-02 15:04:05"), a.Description)
 	}
 	return true
 }
@@ -9,11 +9,12 @@ import (
 )
 
 type AnomalyEngine struct {
-	tdb       *db.TemplateDB
+	tdb       db.Store
 	detectors []AnomalyDetector
+	emit      func([]Anomaly)
 }
 
-func NewAnomalyEngine(tdb *db.TemplateDB) (*AnomalyEngine, error) {
+func NewAnomalyEngine(tdb db.Store) (*AnomalyEngine, error) {
 	ae := AnomalyEngine{}
 	ae.tdb = tdb
 	return &ae, nil
@@ -23,6 +24,12 @@ func (ae *AnomalyEngine) AddAnomalyDetector(ad AnomalyDetector) {
 	ae.detectors = append(ae.detectors, ad)
 }
 
+// Set the callback receiving anomalies detected outside of ProcessTemplate.
+// Must be called before Start
+func (ae *AnomalyEngine) OnAnomalies(emit func([]Anomaly)) {
+	ae.emit = emit
+}
+
 // Process template through detectors to detect anomalies and update
 // template statistics
 // Return slice of anomalies detected
@@ -35,6 +42,12 @@ func (ae *AnomalyEngine) ProcessTemplate(tmpl common.Template) []Anomaly {
 			slog.Error(fmt.Sprintf("Failed to detect anomalies in template %s: %s", tmpl.ID, err))
 			continue
 		}
+		// Attach the workload the template was seen in
+		for i := range as {
+			as[i].K8sMetadata = tmpl.K8sMetadata
+			as[i].Scope = tmpl.Scope
+			as[i].TraceID = tmpl.TraceID
+		}
 		anomalies = append(anomalies, as...)
 	}
 
@@ -45,16 +58,16 @@ func (ae *AnomalyEngine) ProcessTemplate(tmpl common.Template) []Anomaly {
 
 // Update template stats and increase count
 func (ae *AnomalyEngine) updateTemplateStats(tmpl common.Template) error {
-	if err := ae.tdb.CountTemplate(tmpl.ID); err != nil {
+	if err := ae.tdb.CountTemplate(tmpl.ID, tmpl.Timestamp); err != nil {
 		slog.Error("Failed to count template stat:",
 			"error", err)
 	}
-	if err := ae.tdb.CountTemplateHourly(tmpl.ID); err != nil {
+	if err := ae.tdb.CountTemplateHourly(tmpl.ID, tmpl.Timestamp); err != nil {
 		slog.Error("Failed to count template hourly stat:",
 			"error", err)
 	}
 
-	if err := ae.tdb.CountTransition(tmpl.ID, tmpl.K8sMetadata.PodID); err != nil {
+	if err := ae.tdb.CountTransition(tmpl.ID, tmpl.K8sMetadata, tmpl.Timestamp); err != nil {
 		slog.Error("Failed to count template transition:",
 			"error", err)
 	}
@@ -62,14 +75,25 @@ func (ae *AnomalyEngine) updateTemplateStats(tmpl common.Template) error {
 	return nil
 }
 
-func (ae *AnomalyEngine) Start(done <-chan bool) error {
+// Init all detectors, must be called before ProcessTemplate
+func (ae *AnomalyEngine) Init() error {
 	for _, d := range ae.detectors {
 		err := d.Init(ae.tdb)
 		if err != nil {
 			return fmt.Errorf("detector failed to init detector %T", d)
 		}
 
-		err = d.Start(done)
+		if e, ok := d.(AnomalyEmitter); ok && ae.emit != nil {
+			e.SetEmitter(ae.emit)
+		}
+	}
+	return nil
+}
+
+// Start background work of all detectors
+func (ae *AnomalyEngine) Start(done <-chan bool) error {
+	for _, d := range ae.detectors {
+		err := d.Start(done)
 		if err != nil {
 			return fmt.Errorf("detector failed to start detector %T", d)
 		}
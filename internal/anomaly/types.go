@@ -4,21 +4,31 @@ import (
 	"fmt"
 	"log-analyzer/internal/common"
 	"log-analyzer/internal/db"
+	"strings"
 	"time"
 )
 
 type AnomalyDetector interface {
-	Init(tdb *db.TemplateDB) error
+	Init(tdb db.Store) error
 	Start(done <-chan bool) error                  // done to send a signal to start clean up
 	Check(tmpl common.Template) ([]Anomaly, error) // called each time a template is ingested
 }
 
+// Implemented by detectors that also detect anomalies outside of Check,
+// e.g. from a periodic sweep. emit is set before Start is called.
+type AnomalyEmitter interface {
+	SetEmitter(emit func([]Anomaly))
+}
+
 type Anomaly struct {
 	TemplateID  string
 	Type        AnomalyType
 	Severity    Severity
 	Description string
 	Timestamp   time.Time
+	K8sMetadata common.K8sMetadata // workload the anomalous template was seen in
+	Scope       string             // template scope key, empty for the global scope
+	TraceID     string             // trace of the log line that raised the anomaly, if known
 }
 
 type AnomalyType int
@@ -28,6 +38,7 @@ const (
 	AnomalyTypeFrequency
 	AnomalyTypeSequence
 	AnomalyTypeTiming
+	AnomalyTypeSilence
 )
 
 func (at AnomalyType) String() string {
@@ -40,6 +51,8 @@ func (at AnomalyType) String() string {
 		return "Sequence"
 	case AnomalyTypeTiming:
 		return "Timing"
+	case AnomalyTypeSilence:
+		return "Silence"
 	default:
 		return fmt.Sprintf("unknown(%d)", at)
 	}
@@ -75,6 +88,15 @@ func (s Severity) String() string {
 	}
 }
 
+func ParseSeverity(s string) (Severity, error) {
+	for sev := SeverityInfo; sev <= SeverityCritical; sev++ {
+		if strings.EqualFold(s, sev.String()) {
+			return sev, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q (expected info, low, medium, high or critical)", s)
+}
+
 func SeverityFromZScore(score float64) Severity {
 	sev := SeverityInfo
 	switch {
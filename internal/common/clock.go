@@ -0,0 +1,104 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy applied to events that arrive behind the event-time watermark
+type LatePolicy int
+
+const (
+	LatePolicyAccept LatePolicy = iota // account the event at its own timestamp
+	LatePolicyClamp                    // account the event at the watermark
+	LatePolicyDrop                     // discard the event
+)
+
+func (lp LatePolicy) String() string {
+	switch lp {
+	case LatePolicyAccept:
+		return "accept"
+	case LatePolicyClamp:
+		return "clamp"
+	case LatePolicyDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("unknown(%d)", lp)
+	}
+}
+
+func ParseLatePolicy(s string) (LatePolicy, error) {
+	switch strings.ToLower(s) {
+	case "accept":
+		return LatePolicyAccept, nil
+	case "clamp":
+		return LatePolicyClamp, nil
+	case "drop":
+		return LatePolicyDrop, nil
+	}
+	return 0, fmt.Errorf("unknown late event policy %q (expected accept, clamp or drop)", s)
+}
+
+// EventClock resolves the time an event is accounted at.
+// It tracks a watermark (the newest event time seen so far) and applies
+// Policy to events older than the watermark by more than MaxLateness.
+// Events stamped further than MaxSkew in the future are clamped to the
+// wall-clock, and events without a timestamp fall back to the wall-clock.
+type EventClock struct {
+	Policy      LatePolicy
+	MaxLateness time.Duration
+	MaxSkew     time.Duration
+
+	mu         sync.Mutex
+	watermark  time.Time
+	advancedAt time.Time // wall-clock time the watermark last moved
+}
+
+// Returns the time the event should be accounted at, or false if the event
+// should be dropped
+func (ec *EventClock) Resolve(ts time.Time) (time.Time, bool) {
+	now := time.Now().UTC()
+	if ts.IsZero() || ts.After(now.Add(ec.MaxSkew)) {
+		ts = now
+	}
+	ts = ts.UTC()
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ts.Before(ec.watermark.Add(-ec.MaxLateness)) {
+		switch ec.Policy {
+		case LatePolicyClamp:
+			ts = ec.watermark
+		case LatePolicyDrop:
+			return time.Time{}, false
+		}
+	}
+
+	if ts.After(ec.watermark) {
+		ec.watermark = ts
+		ec.advancedAt = now
+	}
+	return ts, true
+}
+
+// Newest event time seen so far
+func (ec *EventClock) Watermark() time.Time {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.watermark
+}
+
+// Current event time: the watermark moved on by the wall-clock time elapsed
+// since it last advanced, so that time keeps passing while no events arrive.
+// Zero until the first event
+func (ec *EventClock) Now() time.Time {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.watermark.IsZero() {
+		return time.Time{}
+	}
+	return ec.watermark.Add(time.Since(ec.advancedAt))
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Index of templates by the token at each position, to find the templates
+// within merge distance of some tokens without comparing every template of
+// the same token count.
+//
+// Templates within maxDist of tokens differ in at most maxDist of their
+// positions, so they share the token, or have a wildcard, in at least one
+// of any maxDist+1 positions where tokens has no wildcard. Only the
+// templates listed under the rarest of those positions are compared.
+//
+// The index isn't safe for concurrent use, TemplateTree only uses it with
+// writeMu held.
+type tokenIndex struct {
+	seq      int // insertion order of the next template
+	entries  map[string]*indexEntry
+	lengths  map[int]map[string]bool // token count to template IDs
+	postings map[postingKey]map[string]bool
+}
+
+type indexEntry struct {
+	leafTemplate
+	seq int
+}
+
+// Token at a position of templates of a token count, Wildcard for any
+// wildcard token
+type postingKey struct {
+	length int
+	pos    int
+	token  string
+}
+
+func newTokenIndex() *tokenIndex {
+	return &tokenIndex{
+		entries:  make(map[string]*indexEntry),
+		lengths:  make(map[int]map[string]bool),
+		postings: make(map[postingKey]map[string]bool),
+	}
+}
+
+func postingOf(length, pos int, token string) postingKey {
+	if isWildcard(token) {
+		token = Wildcard
+	}
+	return postingKey{length: length, pos: pos, token: token}
+}
+
+// Add a template stored at path, or replace the one with the same ID
+// keeping its insertion order
+func (ix *tokenIndex) put(t Template, p treePath) {
+	seq := ix.seq
+	if e, ok := ix.entries[t.ID]; ok {
+		seq = e.seq
+		ix.remove(t.ID)
+	} else {
+		ix.seq++
+	}
+
+	ix.entries[t.ID] = &indexEntry{leafTemplate: leafTemplate{tmpl: t, path: p}, seq: seq}
+	ids := ix.lengths[len(t.Tokens)]
+	if ids == nil {
+		ids = make(map[string]bool)
+		ix.lengths[len(t.Tokens)] = ids
+	}
+	ids[t.ID] = true
+
+	for i, token := range t.Tokens {
+		k := postingOf(len(t.Tokens), i, token)
+		if ix.postings[k] == nil {
+			ix.postings[k] = make(map[string]bool)
+		}
+		ix.postings[k][t.ID] = true
+	}
+}
+
+func (ix *tokenIndex) remove(id string) {
+	e, ok := ix.entries[id]
+	if !ok {
+		return
+	}
+	delete(ix.entries, id)
+
+	length := len(e.tmpl.Tokens)
+	delete(ix.lengths[length], id)
+	for i, token := range e.tmpl.Tokens {
+		k := postingOf(length, i, token)
+		delete(ix.postings[k], id)
+		if len(ix.postings[k]) == 0 {
+			delete(ix.postings, k)
+		}
+	}
+}
+
+// Return the oldest template within maxDist of tokens
+func (ix *tokenIndex) nearest(tokens []string, maxDist int) (leafTemplate, bool) {
+	if maxDist <= 0 {
+		return leafTemplate{}, false
+	}
+
+	// A position lists the templates sharing its token or with a wildcard
+	// there, any maxDist+1 positions without a wildcard hold every
+	// template within maxDist
+	length := len(tokens)
+	type probe struct {
+		exact, wild map[string]bool
+	}
+	var probes []probe
+	for i, token := range tokens {
+		if isWildcard(token) {
+			continue
+		}
+		probes = append(probes, probe{
+			exact: ix.postings[postingKey{length: length, pos: i, token: token}],
+			wild:  ix.postings[postingKey{length: length, pos: i, token: Wildcard}],
+		})
+	}
+
+	var candidates []map[string]bool
+	if len(probes) <= maxDist {
+		// Too few positions to rule anything out
+		candidates = append(candidates, ix.lengths[length])
+	} else {
+		slices.SortFunc(probes, func(a, b probe) int {
+			return cmp.Compare(len(a.exact)+len(a.wild), len(b.exact)+len(b.wild))
+		})
+		for _, p := range probes[:maxDist+1] {
+			candidates = append(candidates, p.exact, p.wild)
+		}
+	}
+
+	var best *indexEntry
+	for _, ids := range candidates {
+		for id := range ids {
+			e := ix.entries[id]
+			if best != nil && e.seq >= best.seq {
+				continue
+			}
+			if withinDistance(e.tmpl.Tokens, tokens, maxDist) {
+				best = e
+			}
+		}
+	}
+	if best == nil {
+		return leafTemplate{}, false
+	}
+	return best.leafTemplate, true
+}
+
+// Return the templates tmpl matches at every position, oldest first
+func (ix *tokenIndex) covered(tmpl []string) []leafTemplate {
+	// Templates tmpl matches have the same token at every position where
+	// tmpl has no wildcard, the rarest of those lists them all
+	length := len(tmpl)
+	ids := ix.lengths[length]
+	for i, token := range tmpl {
+		if isWildcard(token) {
+			continue
+		}
+		exact := ix.postings[postingKey{length: length, pos: i, token: token}]
+		if len(exact) < len(ids) {
+			ids = exact
+		}
+	}
+
+	var matched []*indexEntry
+	for id := range ids {
+		e := ix.entries[id]
+		if similarity(tmpl, e.tmpl.Tokens) == 1 {
+			matched = append(matched, e)
+		}
+	}
+	slices.SortFunc(matched, func(a, b *indexEntry) int { return cmp.Compare(a.seq, b.seq) })
+
+	out := make([]leafTemplate, len(matched))
+	for i, e := range matched {
+		out[i] = e.leafTemplate
+	}
+	return out
+}
@@ -1,12 +1,36 @@
 package common
 
+import (
+	"math"
+	"time"
+)
+
 // fluentbit log event
 type LogEvent struct {
 	Date        float64     `json:"date"`
+	Time        time.Time   `json:"-"` // nanosecond precision event time of sources other than fluentbit, takes precedence over Date
 	Log         string      `json:"log"`
+	Stream      string      `json:"stream"`   // stdout or stderr
+	Partial     string      `json:"_p"`       // CRI tag, P for a partial line continued in the next event, F for a full line
+	Level       string      `json:"level"`    // level set by the source, takes precedence over the level found in the line
+	TraceID     string      `json:"trace_id"` // hex encoded, of sources with tracing context
+	SpanID      string      `json:"span_id"`
 	K8sMetadata K8sMetadata `json:"kubernetes"`
 }
 
+// Event time of Time or decoded from Date, or the zero time if the event
+// has none
+func (le LogEvent) Timestamp() time.Time {
+	if !le.Time.IsZero() {
+		return le.Time.UTC()
+	}
+	if le.Date <= 0 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(le.Date)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC()
+}
+
 type K8sMetadata struct {
 	PodName       string                 `json:"pod_name"`
 	PodID         string                 `json:"pod_id"`
@@ -17,3 +41,12 @@ type K8sMetadata struct {
 	ContainerName string                 `json:"container_name"`
 	ContainerImg  string                 `json:"container_image"`
 }
+
+// Human readable "namespace/pod/container" identifier of the workload,
+// or "-" if the event carried no Kubernetes metadata
+func (m K8sMetadata) Workload() string {
+	if m.Namespace == "" && m.PodName == "" && m.ContainerName == "" {
+		return "-"
+	}
+	return m.Namespace + "/" + m.PodName + "/" + m.ContainerName
+}
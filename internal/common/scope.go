@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TemplateScope partitions the template space by workload, so that the same
+// log line from unrelated services gets a template, stats and anomalies of
+// its own per service.
+type TemplateScope struct {
+	kind  scopeKind
+	label string // label key for scopeLabel
+}
+
+type scopeKind int
+
+const (
+	scopeGlobal scopeKind = iota
+	scopeNamespace
+	scopeContainer
+	scopeLabel
+)
+
+const labelScopePrefix = "label:"
+
+// Parse a scope: global, namespace, namespace+container or label:<key>
+func ParseTemplateScope(s string) (TemplateScope, error) {
+	switch {
+	case s == "" || s == "global":
+		return TemplateScope{kind: scopeGlobal}, nil
+	case s == "namespace":
+		return TemplateScope{kind: scopeNamespace}, nil
+	case s == "namespace+container":
+		return TemplateScope{kind: scopeContainer}, nil
+	case strings.HasPrefix(s, labelScopePrefix) && len(s) > len(labelScopePrefix):
+		return TemplateScope{kind: scopeLabel, label: strings.TrimPrefix(s, labelScopePrefix)}, nil
+	}
+	return TemplateScope{}, fmt.Errorf("unknown template scope %q (expected global, namespace, namespace+container or label:<key>)", s)
+}
+
+func (ts TemplateScope) String() string {
+	switch ts.kind {
+	case scopeNamespace:
+		return "namespace"
+	case scopeContainer:
+		return "namespace+container"
+	case scopeLabel:
+		return labelScopePrefix + ts.label
+	default:
+		return "global"
+	}
+}
+
+func (ts TemplateScope) IsGlobal() bool {
+	return ts.kind == scopeGlobal
+}
+
+// Return the scope key of the workload, empty for the global scope.
+// Workloads without the scope label fall back to namespace+container.
+func (ts TemplateScope) Key(meta K8sMetadata) string {
+	switch ts.kind {
+	case scopeNamespace:
+		return meta.Namespace
+	case scopeContainer:
+		return meta.Namespace + "/" + meta.ContainerName
+	case scopeLabel:
+		if v, ok := meta.Labels[ts.label]; ok {
+			return ts.label + "=" + fmt.Sprint(v)
+		}
+		return meta.Namespace + "/" + meta.ContainerName
+	default:
+		return ""
+	}
+}
@@ -2,48 +2,495 @@ package common
 
 import (
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/google/uuid"
 )
 
+const (
+	// Number of leading tokens used to route a log to a leaf of the tree
+	treeDepth = 2
+	// Max children per tree node, further tokens are routed to the wildcard child
+	treeMaxChildren = 100
+	// Default min share of matching tokens for a log to join a template
+	DefaultSimilarity = 0.7
+	// Default max differing tokens for near-identical templates to be merged
+	DefaultMergeDistance = 2
+
+	Wildcard = "<*>"
+)
+
 type Template struct {
 	ID          string // uuid
+	Scope       string // scope key of the workloads sharing this template, empty for the global scope
 	K8sMetadata K8sMetadata
-	Tokens      []string // the canonical pattern: ["GET", "<NUM>", "users", "<UUID>"]
+	Tokens      []string  // the canonical pattern: ["GET", "<NUM>", "users", "<UUID>"]
+	Timestamp   time.Time // event time of the log line this template was matched from
+	Sample      string    // raw log line this template was matched from
+	Level       string    // log level of the raw log line, one of the Level* constants
+	TraceID     string    // trace and span the log line was written in, if known
+	SpanID      string
+}
+
+// Canonical log levels
+const (
+	LevelTrace = "trace"
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+	LevelFatal = "fatal"
+)
+
+// Return the canonical level of a level name like "WARNING" or "err",
+// or an empty string if the name is not a known level
+func NormalizeLevel(name string) string {
+	switch level := strings.ToLower(name); level {
+	case LevelTrace, LevelDebug, LevelInfo, LevelWarn, LevelError, LevelFatal:
+		return level
+	case "err":
+		return LevelError
+	case "warning":
+		return LevelWarn
+	case "critical", "panic":
+		return LevelFatal
+	default:
+		return ""
+	}
+}
+
+// True if the template was matched from an error or fatal log line
+func (t Template) IsError() bool {
+	return t.Level == LevelError || t.Level == LevelFatal
+}
+
+// TemplateTree is a Drain-style fixed depth parse tree: templates are
+// bucketed by token count, then by their first treeDepth tokens, and a log
+// joins the most similar template of its leaf.
+//
+// Templates of the same token count differing in at most MergeDistance
+// positions are near-identical, e.g. they only differ by a username the
+// masking rules don't catch. Those are merged into one template with
+// wildcards at the differing positions instead of growing a template per
+// value.
+//
+// TemplateTree is safe for concurrent use. Nodes are immutable once
+// published, readers match against the current root without locking and
+// writers are serialized and publish a new root sharing every node off the
+// path they changed, so lookups never wait for a template being written.
+type TemplateTree struct {
+	opts TreeOptions
+
+	root    atomic.Pointer[treeRoot]
+	writeMu sync.Mutex
+	index   *tokenIndex // templates of root by position, guarded by writeMu
+}
+
+type TreeOptions struct {
+	// Min share of matching tokens for a log to join a template,
+	// 0 selects DefaultSimilarity
+	Similarity float64
+	// Max differing tokens for templates to be merged, 0 disables merging
+	MergeDistance int
 }
 
-type TemplateTree map[int][]Template // key = token_count
+// Result of matching tokens against the tree
+type Match struct {
+	Template Template
+	Created  bool     // Template was created for the tokens
+	Updated  bool     // Template was generalized to match the tokens
+	Merged   []string // IDs of templates merged into Template
+}
+
+// Templates merged into Survivor
+type Merge struct {
+	Survivor Template
+	Merged   []string
+}
+
+type treeRoot map[int]*treeNode // key = token_count
 
-func (tt TemplateTree) Find(tokens []string) (Template, bool) {
-	candidates := tt[len(tokens)]
-	for _, tmpl := range candidates {
-		if matchesTemplate(tokens, tmpl.Tokens) {
-			return tmpl, true
+type treeNode struct {
+	children  map[string]*treeNode // routing token to child, inner nodes only
+	templates []Template           // leaves only
+}
+
+func NewTemplateTree(templates map[int][]Template, opts TreeOptions) *TemplateTree {
+	if opts.Similarity <= 0 {
+		opts.Similarity = DefaultSimilarity
+	}
+	tt := &TemplateTree{opts: opts}
+	tt.Load(templates)
+	return tt
+}
+
+// Replace all templates in the tree
+func (tt *TemplateTree) Load(templates map[int][]Template) {
+	root := treeRoot{}
+	index := newTokenIndex()
+	for _, bucket := range templates {
+		for _, t := range bucket {
+			p := root.route(t.Tokens)
+			root.add(p, t)
+			index.put(t, p)
 		}
 	}
-	return Template{}, false
+
+	tt.writeMu.Lock()
+	defer tt.writeMu.Unlock()
+	tt.root.Store(&root)
+	tt.index = index
 }
 
-func (tt TemplateTree) Save(tokens []string) Template {
-	// Create new template and return its UUID
-	t := Template{ID: uuid.NewString(), Tokens: tokens}
-	tt[len(tokens)] = append(tt[len(tokens)], t)
-	return t
+// Find the template matching all tokens
+func (tt *TemplateTree) Find(tokens []string) (Template, bool) {
+	t, sim, _ := tt.load().search(tokens)
+	return t, sim == 1
 }
 
-func matchesTemplate(tokens, tmpl []string) bool {
-	if len(tokens) != len(tmpl) {
-		return false
+// Return the template tokens belong to, creating it if there is none.
+// If tokens only join a template by similarity or merge distance, the
+// template is generalized in place: its differing tokens become wildcards,
+// and templates it now covers are merged into it.
+// Concurrent callers with the same tokens get the same template, and only
+// one of them is told it created it.
+func (tt *TemplateTree) Match(tokens []string) Match {
+	if t, sim, _ := tt.load().search(tokens); sim == 1 {
+		return Match{Template: t}
 	}
-	for i := range tokens {
-		if tmpl[i] == tokens[i] {
+
+	tt.writeMu.Lock()
+	defer tt.writeMu.Unlock()
+
+	// Another writer may have changed the tree while waiting for the lock
+	root := tt.load()
+	t, sim, path := root.search(tokens)
+	if sim == 1 {
+		return Match{Template: t}
+	}
+	if sim < tt.opts.Similarity {
+		lt, ok := tt.index.nearest(tokens, tt.opts.MergeDistance)
+		if !ok {
+			t = Template{ID: uuid.NewString(), Tokens: tokens}
+			p := root.route(tokens)
+			next := root.with(p, t)
+			tt.root.Store(&next)
+			tt.index.put(t, p)
+			return Match{Template: t, Created: true}
+		}
+		t, path = lt.tmpl, lt.path
+	}
+
+	m := Match{Template: Template{ID: t.ID, Tokens: generalize(t.Tokens, tokens)}, Updated: true}
+	root = root.without(path, t.ID)
+
+	// Fold templates the generalized one now covers into it
+	for _, lt := range tt.index.covered(m.Template.Tokens) {
+		if lt.tmpl.ID == t.ID {
+			continue
+		}
+		root = root.without(lt.path, lt.tmpl.ID)
+		tt.index.remove(lt.tmpl.ID)
+		m.Merged = append(m.Merged, lt.tmpl.ID)
+	}
+
+	p := root.route(m.Template.Tokens)
+	next := root.with(p, m.Template)
+	tt.root.Store(&next)
+	tt.index.put(m.Template, p)
+	return m
+}
+
+// Merge all near-identical templates of the tree, e.g. ones created before
+// merging was enabled. Templates are visited in the order they were loaded
+// and merged into the first template within MergeDistance.
+func (tt *TemplateTree) Compact(order []string) []Merge {
+	if tt.opts.MergeDistance <= 0 {
+		return nil
+	}
+
+	tt.writeMu.Lock()
+	defer tt.writeMu.Unlock()
+
+	byID := make(map[string]Template, len(tt.index.entries))
+	for id, e := range tt.index.entries {
+		byID[id] = e.tmpl
+	}
+
+	// Survivors are indexed in the order they were visited, so the oldest
+	// one within distance is the first
+	survivors := newTokenIndex()
+	var visited []*Merge
+	survivorOf := make(map[string]*Merge)
+	for _, id := range order {
+		t, ok := byID[id]
+		if !ok {
 			continue
 		}
-		// Wildcards match anything
-		if strings.HasPrefix(tmpl[i], "<") && strings.HasSuffix(tmpl[i], ">") {
+		delete(byID, id)
+
+		lt, ok := survivors.nearest(t.Tokens, tt.opts.MergeDistance)
+		if !ok {
+			m := &Merge{Survivor: t}
+			survivorOf[t.ID] = m
+			visited = append(visited, m)
+			survivors.put(t, treePath{})
 			continue
 		}
+		into := survivorOf[lt.tmpl.ID]
+		into.Survivor.Tokens = generalize(into.Survivor.Tokens, t.Tokens)
+		into.Merged = append(into.Merged, t.ID)
+		survivors.put(into.Survivor, treePath{})
+	}
+
+	// Templates missing from order are kept as they are
+	next := treeRoot{}
+	index := newTokenIndex()
+	for _, t := range byID {
+		p := next.route(t.Tokens)
+		next.add(p, t)
+		index.put(t, p)
+	}
+
+	var merges []Merge
+	for _, m := range visited {
+		p := next.route(m.Survivor.Tokens)
+		next.add(p, m.Survivor)
+		index.put(m.Survivor, p)
+		if len(m.Merged) > 0 {
+			merges = append(merges, *m)
+		}
+	}
+	tt.root.Store(&next)
+	tt.index = index
+	return merges
+}
+
+func (tt *TemplateTree) load() treeRoot {
+	if r := tt.root.Load(); r != nil {
+		return *r
+	}
+	return nil
+}
+
+// Leaf path of a template: token count followed by routing keys
+type treePath struct {
+	length int
+	keys   []string
+}
+
+// Path new tokens are stored at
+func (r treeRoot) route(tokens []string) treePath {
+	p := treePath{length: len(tokens)}
+	node := r[len(tokens)]
+	for i := 0; i < treeDepth && i < len(tokens); i++ {
+		key := routeKey(tokens[i])
+		var child *treeNode
+		if node != nil {
+			child = node.children[key]
+			if child == nil && len(node.children) >= treeMaxChildren {
+				key = Wildcard
+				child = node.children[key]
+			}
+		}
+		p.keys = append(p.keys, key)
+		node = child
+	}
+	return p
+}
+
+// Return the most similar template to tokens with its similarity and path.
+// Both the exact and the wildcard branch are followed at each level, so at
+// most 2^treeDepth leaves are compared.
+func (r treeRoot) search(tokens []string) (best Template, bestSim float64, bestPath treePath) {
+	var walk func(n *treeNode, depth int, keys []string)
+	walk = func(n *treeNode, depth int, keys []string) {
+		if n == nil {
+			return
+		}
+		if depth == treeDepth || depth == len(tokens) {
+			for _, t := range n.templates {
+				sim := similarity(t.Tokens, tokens)
+				if sim > bestSim || (sim == bestSim && sim > 0 && wildcards(t.Tokens) < wildcards(best.Tokens)) {
+					best, bestSim = t, sim
+					bestPath = treePath{length: len(tokens), keys: append([]string(nil), keys...)}
+				}
+			}
+			return
+		}
+
+		key := routeKey(tokens[depth])
+		walk(n.children[key], depth+1, append(keys, key))
+		if key != Wildcard {
+			walk(n.children[Wildcard], depth+1, append(keys, Wildcard))
+		}
+	}
+	walk(r[len(tokens)], 0, nil)
+	return
+}
+
+type leafTemplate struct {
+	tmpl Template
+	path treePath
+}
+
+// Store t at path in place, only for trees that aren't published yet
+func (r treeRoot) add(p treePath, t Template) {
+	node := r[p.length]
+	if node == nil {
+		node = &treeNode{}
+		r[p.length] = node
+	}
+	for _, k := range p.keys {
+		if node.children == nil {
+			node.children = make(map[string]*treeNode)
+		}
+		child := node.children[k]
+		if child == nil {
+			child = &treeNode{}
+			node.children[k] = child
+		}
+		node = child
+	}
+	node.templates = append(node.templates, t)
+}
+
+// Return a copy of the tree with t stored at path, replacing the template
+// with the same ID if the leaf has one
+func (r treeRoot) with(p treePath, t Template) treeRoot {
+	next := make(treeRoot, len(r)+1)
+	for k, v := range r {
+		next[k] = v
+	}
+	next[p.length] = r[p.length].with(p.keys, t)
+	return next
+}
+
+func (n *treeNode) with(keys []string, t Template) *treeNode {
+	next := &treeNode{}
+	if len(keys) == 0 {
+		if n != nil {
+			next.templates = make([]Template, 0, len(n.templates)+1)
+			for _, old := range n.templates {
+				if old.ID != t.ID {
+					next.templates = append(next.templates, old)
+				}
+			}
+		}
+		next.templates = append(next.templates, t)
+		return next
+	}
+
+	next.children = make(map[string]*treeNode)
+	var child *treeNode
+	if n != nil {
+		for k, v := range n.children {
+			next.children[k] = v
+		}
+		child = n.children[keys[0]]
+	}
+	next.children[keys[0]] = child.with(keys[1:], t)
+	return next
+}
+
+// Return a copy of the tree without the template id stored at path
+func (r treeRoot) without(p treePath, id string) treeRoot {
+	next := make(treeRoot, len(r))
+	for k, v := range r {
+		next[k] = v
+	}
+	next[p.length] = r[p.length].without(p.keys, id)
+	return next
+}
+
+func (n *treeNode) without(keys []string, id string) *treeNode {
+	if n == nil {
+		return nil
+	}
+	next := &treeNode{}
+	if len(keys) == 0 {
+		for _, old := range n.templates {
+			if old.ID != id {
+				next.templates = append(next.templates, old)
+			}
+		}
+		return next
+	}
+
+	next.children = make(map[string]*treeNode, len(n.children))
+	for k, v := range n.children {
+		next.children[k] = v
+	}
+	next.children[keys[0]] = n.children[keys[0]].without(keys[1:], id)
+	return next
+}
+
+// Tokens that are, or look like, variables all share the wildcard branch
+func routeKey(token string) string {
+	if isWildcard(token) || strings.ContainsFunc(token, unicode.IsDigit) {
+		return Wildcard
+	}
+	return token
+}
+
+// Share of template tokens matching tokens, wildcards match anything
+func similarity(tmpl, tokens []string) float64 {
+	if len(tmpl) != len(tokens) {
+		return 0
+	}
+	if len(tokens) == 0 {
+		return 1
+	}
+	matched := 0
+	for i := range tokens {
+		if tmpl[i] == tokens[i] || isWildcard(tmpl[i]) {
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(tokens))
+}
+
+// True if the templates differ in at most maxDist tokens, and in fewer
+// than half of them so that short templates don't collapse into wildcards
+func withinDistance(a, b []string, maxDist int) bool {
+	if len(a) != len(b) || maxDist <= 0 {
 		return false
 	}
-	return true
+	diff := 0
+	for i := range a {
+		if a[i] != b[i] && !isWildcard(a[i]) && !isWildcard(b[i]) {
+			diff++
+		}
+	}
+	return diff <= maxDist && 2*diff < len(a)
+}
+
+// Replace the template tokens differing from tokens with wildcards
+func generalize(tmpl, tokens []string) []string {
+	out := make([]string, len(tmpl))
+	for i := range tmpl {
+		if tmpl[i] == tokens[i] || isWildcard(tmpl[i]) {
+			out[i] = tmpl[i]
+		} else {
+			out[i] = Wildcard
+		}
+	}
+	return out
+}
+
+func wildcards(tokens []string) int {
+	n := 0
+	for _, t := range tokens {
+		if isWildcard(t) {
+			n++
+		}
+	}
+	return n
+}
+
+func isWildcard(token string) bool {
+	return strings.HasPrefix(token, "<") && strings.HasSuffix(token, ">")
 }
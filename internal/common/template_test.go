@@ -0,0 +1,165 @@
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Log-like templates of 5 to 15 tokens: a component and an action out of a
+// few dozen each, then words drawn from a vocabulary of vocab words and
+// some masked variables
+func randomTemplates(r *rand.Rand, n int, vocab int) [][]string {
+	masks := []string{"<NUM>", "<IP>", "<UUID>", "<HEX>"}
+	out := make([][]string, n)
+	for i := range out {
+		tokens := make([]string, 5+r.Intn(11))
+		tokens[0] = word(r.Intn(40))
+		tokens[1] = word(40 + r.Intn(60))
+		for j := 2; j < len(tokens); j++ {
+			if r.Intn(5) == 0 {
+				tokens[j] = masks[r.Intn(len(masks))]
+			} else {
+				tokens[j] = word(r.Intn(vocab))
+			}
+		}
+		out[i] = tokens
+	}
+	return out
+}
+
+// Words without digits, which would route like variables
+func word(n int) string {
+	w := []byte("w")
+	for ; n > 0; n /= 26 {
+		w = append(w, byte('a'+n%26))
+	}
+	return string(w)
+}
+
+func TestNearestMatchesScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	templates := randomTemplates(r, 2000, 20)
+
+	ix := newTokenIndex()
+	for i, tokens := range templates {
+		ix.put(Template{ID: fmt.Sprint(i), Tokens: tokens}, treePath{})
+	}
+
+	for _, tokens := range randomTemplates(r, 2000, 20) {
+		for maxDist := 1; maxDist <= 3; maxDist++ {
+			want := -1
+			for i, tmpl := range templates {
+				if withinDistance(tmpl, tokens, maxDist) {
+					want = i
+					break
+				}
+			}
+
+			lt, ok := ix.nearest(tokens, maxDist)
+			got := -1
+			if ok {
+				fmt.Sscan(lt.tmpl.ID, &got)
+			}
+			if got != want {
+				t.Fatalf("nearest %v within %d: got template %d, want %d", tokens, maxDist, got, want)
+			}
+		}
+	}
+}
+
+func TestMatchMergesNearIdentical(t *testing.T) {
+	tt := NewTemplateTree(nil, TreeOptions{MergeDistance: 2})
+
+	a := tt.Match([]string{"user", "alice", "logged", "in", "from", "<IP>"})
+	if !a.Created {
+		t.Fatal("first template not created")
+	}
+	b := tt.Match([]string{"user", "bob", "logged", "in", "from", "<IP>"})
+	if b.Template.ID != a.Template.ID || !b.Updated {
+		t.Fatalf("near-identical line got template %+v, want %s generalized", b, a.Template.ID)
+	}
+
+	want := []string{"user", Wildcard, "logged", "in", "from", "<IP>"}
+	if fmt.Sprint(b.Template.Tokens) != fmt.Sprint(want) {
+		t.Fatalf("got tokens %v, want %v", b.Template.Tokens, want)
+	}
+	if c, ok := tt.Find([]string{"user", "carol", "logged", "in", "from", "<IP>"}); !ok || c.ID != a.Template.ID {
+		t.Fatalf("generalized template doesn't match, got %+v", c)
+	}
+}
+
+// Match as done before the parse tree: the first template of the same token
+// count matching every token
+func linearFind(templates map[int][]Template, tokens []string) (Template, bool) {
+	for _, tmpl := range templates[len(tokens)] {
+		if similarity(tmpl.Tokens, tokens) == 1 {
+			return tmpl, true
+		}
+	}
+	return Template{}, false
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		r := rand.New(rand.NewSource(1))
+		templates := make(map[int][]Template)
+		var lines [][]string
+		for i, tokens := range randomTemplates(r, n, 1000) {
+			t := Template{ID: fmt.Sprint(i), Tokens: tokens}
+			templates[len(tokens)] = append(templates[len(tokens)], t)
+			lines = append(lines, tokens)
+		}
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearFind(templates, lines[i%len(lines)])
+			}
+		})
+
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			tt := NewTemplateTree(templates, TreeOptions{MergeDistance: DefaultMergeDistance})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tt.Match(lines[i%len(lines)])
+			}
+		})
+
+		// Lines of no template, each one is compared for merge distance
+		// then added
+		misses := randomTemplates(r, 10000, 1000)
+		b.Run(fmt.Sprintf("tree-miss/%d", n), func(b *testing.B) {
+			tt := NewTemplateTree(templates, TreeOptions{MergeDistance: DefaultMergeDistance})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%len(misses) == 0 {
+					b.StopTimer()
+					tt.Load(templates)
+					b.StartTimer()
+				}
+				tt.Match(misses[i%len(misses)])
+			}
+		})
+	}
+}
+
+func BenchmarkCompact(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		r := rand.New(rand.NewSource(1))
+		templates := make(map[int][]Template)
+		var order []string
+		for i, tokens := range randomTemplates(r, n, 1000) {
+			t := Template{ID: fmt.Sprint(i), Tokens: tokens}
+			templates[len(tokens)] = append(templates[len(tokens)], t)
+			order = append(order, t.ID)
+		}
+
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			tt := NewTemplateTree(nil, TreeOptions{MergeDistance: DefaultMergeDistance})
+			for i := 0; i < b.N; i++ {
+				tt.Load(templates)
+				tt.Compact(order)
+			}
+		})
+	}
+}
@@ -0,0 +1,468 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	common "log-analyzer/internal/common"
+)
+
+const (
+	// Transitions into a template in a pod container that haven't been
+	// counted or read for this long are dropped from memory
+	transitionIdleTimeout = 10 * time.Minute
+)
+
+// Write-behind cache of the template counters.
+// Counting only updates memory and the detectors read the counters from
+// memory, the changes are written to the DB in one transaction per flush.
+// Counters are loaded from the DB on first use, once the flush in progress
+// if any is done, with the pending changes applied on top.
+type counters struct {
+	stats       map[string]*statsEntry // template ID to IAT stats, nil if not in the DB
+	hourly      map[string]*hourlyWindow
+	transitions map[transitionGroup]*transitionEntries
+	inserted    map[string]string // template ID to the last hour given a row by InsertHourlyRow
+
+	dirty    pending    // changes not written yet
+	flushing bool       // changes are being written
+	flushed  *sync.Cond // signaled when the write is done
+}
+
+type statsEntry struct {
+	count     int
+	lastSeen  string
+	mean      float64
+	stddev    float64
+	iatLastTs string
+}
+
+// Hourly counts of a template for every hour after `after`
+type hourlyWindow struct {
+	after  string
+	latest time.Time // latest event time counted or read
+	counts map[string]int
+}
+
+type hourKey struct {
+	templateID string
+	hour       string
+}
+
+// Transitions into a template within a pod container
+type transitionGroup struct {
+	dstTemplateID string
+	podID         string
+	containerName string
+}
+
+type transitionEntries struct {
+	srcs     map[string]int // source template ID to count
+	total    int
+	lastUsed time.Time
+}
+
+type transitionKey struct {
+	srcTemplateID string
+	group         transitionGroup
+}
+
+type transitionDelta struct {
+	count     int
+	lastSeen  string
+	podName   string
+	namespace string
+}
+
+type pending struct {
+	stats       map[string]statsEntry
+	hours       map[hourKey]int // hour to count increment
+	transitions map[transitionKey]transitionDelta
+}
+
+func newPending() pending {
+	return pending{
+		stats:       make(map[string]statsEntry),
+		hours:       make(map[hourKey]int),
+		transitions: make(map[transitionKey]transitionDelta),
+	}
+}
+
+func (p pending) empty() bool {
+	return len(p.stats) == 0 && len(p.hours) == 0 && len(p.transitions) == 0
+}
+
+// Fold changes taken by a failed flush back in, older than the ones in p
+func (p pending) restore(old pending) {
+	for uuid, st := range old.stats {
+		if _, ok := p.stats[uuid]; !ok {
+			p.stats[uuid] = st
+		}
+	}
+	for k, n := range old.hours {
+		p.hours[k] += n
+	}
+	for k, d := range old.transitions {
+		p.transitions[k] = d.add(p.transitions[k])
+	}
+}
+
+func (d transitionDelta) add(o transitionDelta) transitionDelta {
+	d.count += o.count
+	d.lastSeen = max(d.lastSeen, o.lastSeen)
+	if o.podName != "" || o.namespace != "" {
+		d.podName, d.namespace = o.podName, o.namespace
+	}
+	return d
+}
+
+func newCounters(mu *sync.Mutex) counters {
+	return counters{
+		stats:       make(map[string]*statsEntry),
+		hourly:      make(map[string]*hourlyWindow),
+		transitions: make(map[transitionGroup]*transitionEntries),
+		inserted:    make(map[string]string),
+		dirty:       newPending(),
+		flushed:     sync.NewCond(mu),
+	}
+}
+
+// Wait for the flush in progress so loads neither wait on its transaction
+// while holding the lock nor miss the changes it's writing
+func (tdb *TemplateDB) waitFlushLocked() {
+	for tdb.cache.flushing {
+		tdb.cache.flushed.Wait()
+	}
+}
+
+// Get the IAT stats of uuid, loading them if needed.
+// Returns nil if the template has never been counted
+func (tdb *TemplateDB) statsLocked(uuid string) (*statsEntry, error) {
+	if st, ok := tdb.cache.stats[uuid]; ok {
+		return st, nil
+	}
+
+	tdb.waitFlushLocked()
+	if st, ok := tdb.cache.stats[uuid]; ok {
+		return st, nil
+	}
+
+	var st statsEntry
+	var lastSeen, iatLastTs sql.NullString
+	err := tdb.db.QueryRow(`
+		SELECT total_count, last_seen, iat_mean, iat_stddev, iat_last_timestamp
+		FROM template_stats
+		WHERE template_id = ?;
+	`, uuid).Scan(&st.count, &lastSeen, &st.mean, &st.stddev, &iatLastTs)
+	if err == sql.ErrNoRows {
+		tdb.cache.stats[uuid] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st.lastSeen, st.iatLastTs = lastSeen.String, iatLastTs.String
+	tdb.cache.stats[uuid] = &st
+	return &st, nil
+}
+
+// Get the hourly counts of uuid covering the lookback window of event time
+// ts, loading the hours missing
+func (tdb *TemplateDB) hourlyLocked(uuid string, ts time.Time) (*hourlyWindow, error) {
+	cutoff := ts.UTC().Add(-time.Hour * metricsLookbackHours).Format(hourTimeFormat)
+
+	w, ok := tdb.cache.hourly[uuid]
+	if !ok || cutoff < w.after {
+		tdb.waitFlushLocked()
+		w, ok = tdb.cache.hourly[uuid]
+	}
+	if !ok {
+		w = &hourlyWindow{after: cutoff, latest: ts, counts: make(map[string]int)}
+		if err := tdb.loadHours(uuid, w, cutoff, ""); err != nil {
+			return nil, err
+		}
+		tdb.cache.hourly[uuid] = w
+	} else if cutoff < w.after {
+		// Late event, read the hours it looks back on
+		if err := tdb.loadHours(uuid, w, cutoff, w.after); err != nil {
+			return nil, err
+		}
+		w.after = cutoff
+	}
+
+	if ts.After(w.latest) {
+		w.latest = ts
+	}
+	return w, nil
+}
+
+// Load the hourly counts after `after`, up to and including `until` unless
+// it's empty
+func (tdb *TemplateDB) loadHours(uuid string, w *hourlyWindow, after string, until string) error {
+	query := `
+		SELECT hour, count
+		FROM template_hourly_counts
+		WHERE template_id = ? AND hour > ?`
+	args := []any{uuid, after}
+	if until != "" {
+		query += " AND hour <= ?"
+		args = append(args, until)
+	}
+
+	rows, err := tdb.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hour string
+		var count int
+		if err := rows.Scan(&hour, &count); err != nil {
+			return err
+		}
+		w.counts[hour] = count
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	inRange := func(hour string) bool {
+		return hour > after && (until == "" || hour <= until)
+	}
+	for k, n := range tdb.cache.dirty.hours {
+		if k.templateID == uuid && inRange(k.hour) {
+			w.counts[k.hour] += n
+		}
+	}
+	return nil
+}
+
+// Get the transitions into the group, loading them if needed
+func (tdb *TemplateDB) transitionsLocked(g transitionGroup) (*transitionEntries, error) {
+	if te, ok := tdb.cache.transitions[g]; ok {
+		te.lastUsed = time.Now()
+		return te, nil
+	}
+
+	tdb.waitFlushLocked()
+	if te, ok := tdb.cache.transitions[g]; ok {
+		te.lastUsed = time.Now()
+		return te, nil
+	}
+
+	rows, err := tdb.db.Query(`
+		SELECT src_template_id, count
+		FROM template_transitions
+		WHERE dst_template_id = ? AND pod_id = ? AND container_name = ?;
+	`, g.dstTemplateID, g.podID, g.containerName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	te := &transitionEntries{srcs: make(map[string]int), lastUsed: time.Now()}
+	for rows.Next() {
+		var src string
+		var count int
+		if err := rows.Scan(&src, &count); err != nil {
+			return nil, err
+		}
+		te.srcs[src] = count
+		te.total += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for k, d := range tdb.cache.dirty.transitions {
+		if k.group == g {
+			te.srcs[k.srcTemplateID] += d.count
+			te.total += d.count
+		}
+	}
+
+	tdb.cache.transitions[g] = te
+	return te, nil
+}
+
+// Write all pending counter changes to the DB in one transaction.
+// Counters changed since the last successful flush are lost on a crash
+func (tdb *TemplateDB) Flush() error {
+	tdb.flushMu.Lock()
+	defer tdb.flushMu.Unlock()
+
+	if tdb.closed {
+		return nil
+	}
+
+	tdb.mu.Lock()
+	p := tdb.takePendingLocked()
+	tdb.mu.Unlock()
+	if p.empty() {
+		return nil
+	}
+
+	err := tdb.writePendingTx(p)
+
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+	if err != nil {
+		tdb.cache.dirty.restore(p)
+	}
+	tdb.cache.flushing = false
+	tdb.cache.flushed.Broadcast()
+	return err
+}
+
+func (tdb *TemplateDB) writePendingTx(p pending) error {
+	tx, err := tdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := writePending(tx, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Periodically flush the counters until done is closed
+func (tdb *TemplateDB) StartFlush(interval time.Duration, done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := tdb.Flush(); err != nil {
+					slog.Error(fmt.Sprintf("Failed to flush template counters: %s", err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Take the pending changes to write and drop counters that are no longer
+// needed in memory
+func (tdb *TemplateDB) takePendingLocked() pending {
+	p := tdb.cache.dirty
+	tdb.cache.flushing = !p.empty()
+	tdb.cache.dirty = newPending()
+
+	// Hours before the lookback window of the latest event
+	for _, w := range tdb.cache.hourly {
+		cutoff := w.latest.UTC().Add(-time.Hour * metricsLookbackHours).Format(hourTimeFormat)
+		if cutoff <= w.after {
+			continue
+		}
+		for hour := range w.counts {
+			if hour <= cutoff {
+				delete(w.counts, hour)
+			}
+		}
+		w.after = cutoff
+	}
+
+	idleSince := time.Now().Add(-transitionIdleTimeout)
+	for g, te := range tdb.cache.transitions {
+		if te.lastUsed.Before(idleSince) {
+			delete(tdb.cache.transitions, g)
+		}
+	}
+
+	return p
+}
+
+func writePending(tx *sql.Tx, p pending) error {
+	stats, err := tx.Prepare(`
+		INSERT INTO template_stats
+			(template_id, total_count, last_seen, iat_mean, iat_stddev, iat_last_timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (template_id) DO UPDATE SET
+			total_count = excluded.total_count,
+			last_seen = excluded.last_seen,
+			iat_mean = excluded.iat_mean,
+			iat_stddev = excluded.iat_stddev,
+			iat_last_timestamp = excluded.iat_last_timestamp;
+	`)
+	if err != nil {
+		return err
+	}
+	defer stats.Close()
+
+	for uuid, st := range p.stats {
+		_, err := stats.Exec(uuid, st.count, nullString(st.lastSeen), st.mean, st.stddev, nullString(st.iatLastTs))
+		if err != nil {
+			return fmt.Errorf("failed to write stats: %s", err)
+		}
+	}
+
+	hours, err := tx.Prepare(`
+		INSERT INTO template_hourly_counts (template_id, hour, count)
+		VALUES (?, ?, ?)
+		ON CONFLICT (template_id, hour) DO UPDATE SET
+			count = count + excluded.count;
+	`)
+	if err != nil {
+		return err
+	}
+	defer hours.Close()
+
+	for k, n := range p.hours {
+		if _, err := hours.Exec(k.templateID, k.hour, n); err != nil {
+			return fmt.Errorf("failed to write hourly counts: %s", err)
+		}
+	}
+
+	transitions, err := tx.Prepare(`
+		INSERT INTO template_transitions
+			(src_template_id, dst_template_id, pod_id, container_name, pod_name, namespace, count, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (src_template_id, dst_template_id, pod_id, container_name) DO UPDATE SET
+			count = count + excluded.count,
+			last_seen = MAX(last_seen, excluded.last_seen);
+	`)
+	if err != nil {
+		return err
+	}
+	defer transitions.Close()
+
+	for k, d := range p.transitions {
+		_, err := transitions.Exec(
+			k.srcTemplateID, k.group.dstTemplateID, k.group.podID, k.group.containerName,
+			d.podName, d.namespace, d.count, d.lastSeen,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to write transitions: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Drop the cached counters of the templates and every cached transition,
+// they're read again from the DB on next use
+func (tdb *TemplateDB) invalidateLocked(uuids []string) {
+	for _, uuid := range uuids {
+		delete(tdb.cache.stats, uuid)
+		delete(tdb.cache.hourly, uuid)
+		delete(tdb.cache.inserted, uuid)
+	}
+	clear(tdb.cache.transitions)
+}
+
+func groupOf(dst string, meta common.K8sMetadata) transitionGroup {
+	return transitionGroup{dstTemplateID: dst, podID: meta.PodID, containerName: meta.ContainerName}
+}
@@ -1,81 +1,85 @@
 package db
 
 import (
-	"database/sql"
 	"fmt"
 	"math"
 	"time"
+
+	common "log-analyzer/internal/common"
 )
 
-// Update template count stat
-func (tdb *TemplateDB) CountTemplate(uuid string) error {
-	// Insert new rows for new template
-	_, err := tdb.db.Exec(`
-		INSERT OR IGNORE INTO template_stats (template_id) VALUES (?);
-	`, uuid)
-	if err != nil {
-		return fmt.Errorf("failed to insert new template stats row: %s", err)
-	}
+// Update template count stat for an occurrence at event time ts
+func (tdb *TemplateDB) CountTemplate(uuid string, ts time.Time) error {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
 
-	// Calculate IAT stats
-	count, iatMean, iatStddev, iatLastTimestamp, err := tdb.GetIATStats(uuid)
+	st, err := tdb.statsLocked(uuid)
 	if err != nil {
 		return fmt.Errorf("failed to get IAT stats: %s", err)
 	}
+	if st == nil {
+		st = &statsEntry{}
+		tdb.cache.stats[uuid] = st
+	}
 
-	newMean, newStddev, err := calculateIAT(
-		iatLastTimestamp, iatMean, iatStddev, count,
+	// Calculate IAT stats
+	newMean, newStddev, inOrder, err := calculateIAT(
+		st.iatLastTs, st.mean, st.stddev, st.count, ts,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to calculate IAT stats: %s", err)
 	}
 
-	// Update stats
-	currTs := time.Now().UTC().Format(TimestampFormat)
-	_, err = tdb.db.Exec(`
-		UPDATE template_stats
-		SET total_count = total_count + 1,
-			last_seen = ?,
-			iat_mean = ?,
-			iat_stddev = ?,
-			iat_last_timestamp = ?
-		WHERE template_id = ?
-	`, currTs, newMean, newStddev, currTs, uuid)
-	if err != nil {
-		return fmt.Errorf("failed to update stats: %s", err)
+	// Out-of-order events only count towards the total, they must not
+	// move last_seen backwards or feed a negative IAT into the stats
+	st.count++
+	if inOrder {
+		currTs := ts.UTC().Format(TimestampFormat)
+		st.lastSeen, st.iatLastTs = currTs, currTs
+		st.mean, st.stddev = newMean, newStddev
 	}
+	tdb.cache.dirty.stats[uuid] = *st
 
 	return nil
 }
 
-// Fetch IAT stats for uuid
+// Fetch IAT stats for uuid, ErrNotCounted if it has never been counted
 func (tdb *TemplateDB) GetIATStats(uuid string) (count int, mean float64, stddev float64, lastTs string, err error) {
-	row := tdb.db.QueryRow(`
-		SELECT total_count, iat_mean, iat_stddev, iat_last_timestamp
-		FROM template_stats
-		WHERE template_id = ?;
-	`, uuid)
-
-	var iatLastTimestamp sql.NullString
-	err = row.Scan(&count, &mean, &stddev, &iatLastTimestamp)
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+
+	st, err := tdb.statsLocked(uuid)
 	if err != nil {
 		return
 	}
+	if st == nil {
+		err = ErrNotCounted
+		return
+	}
 
-	lastTs = iatLastTimestamp.String
-	return
+	return st.count, st.mean, st.stddev, st.iatLastTs, nil
 }
 
-func calculateIAT(lastTimestamp string, mean float64, stddev float64, count int) (float64, float64, error) {
+// Welford update of the IAT stats with an arrival at ts.
+// Returns false if ts is older than lastTimestamp, in which case the stats
+// are returned unchanged
+func calculateIAT(lastTimestamp string, mean float64, stddev float64, count int, ts time.Time) (float64, float64, bool, error) {
 	// No previous timestamp
 	if len(lastTimestamp) == 0 {
-		return mean, stddev, nil
+		return mean, stddev, true, nil
 	}
 
 	// Calculate new IAT stats
 	lastTime, err := time.Parse(TimestampFormat, lastTimestamp)
 	if err != nil {
-		return 0.0, 0.0, err
+		return 0.0, 0.0, false, err
+	}
+
+	// Truncate to the stored precision so events within the same second
+	// are not treated as out of order
+	iat := ts.UTC().Truncate(time.Second).Sub(lastTime).Seconds()
+	if iat < 0 {
+		return mean, stddev, false, nil
 	}
 
 	// Recover old M2
@@ -86,9 +90,6 @@ func calculateIAT(lastTimestamp string, mean float64, stddev float64, count int)
 
 	newCount := count + 1
 
-	// Welford update
-	iat := time.Now().UTC().Sub(lastTime).Seconds()
-
 	// Calculate new mean
 	newMean := 0.0
 	newStddev := 0.0
@@ -104,78 +105,127 @@ func calculateIAT(lastTimestamp string, mean float64, stddev float64, count int)
 		newStddev = math.Sqrt(variance)
 	}
 
-	return newMean, newStddev, nil
+	return newMean, newStddev, true, nil
 }
 
-// Update hourly count for template
-func (tdb *TemplateDB) CountTemplateHourly(uuid string) error {
-	err := tdb.InsertHourlyRow(uuid)
-	if err != nil {
-		return err
-	}
+// Update hourly count for template in the hour containing event time ts
+func (tdb *TemplateDB) CountTemplateHourly(uuid string, ts time.Time) error {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
 
-	currentHour := time.Now().UTC().Format(hourTimeFormat)
-	_, err = tdb.db.Exec(`
-		UPDATE template_hourly_counts
-		SET count = count + 1
-		WHERE template_id = ? AND hour = ?
-	`, uuid, currentHour)
+	w, err := tdb.hourlyLocked(uuid, ts)
 	if err != nil {
 		return err
 	}
 
+	currentHour := ts.UTC().Format(hourTimeFormat)
+	w.counts[currentHour]++
+	tdb.cache.dirty.hours[hourKey{uuid, currentHour}]++
+
 	return nil
 }
 
-// Insert new hourly count row for new template
-func (tdb *TemplateDB) InsertHourlyRow(uuid string) error {
-	currentHour := time.Now().UTC().Format(hourTimeFormat)
-	_, err := tdb.db.Exec(`
-		INSERT OR IGNORE INTO template_hourly_counts (template_id, hour)
-		VALUES (?, ?);
-	`, uuid, currentHour)
-	if err != nil {
-		return err
+// Insert new hourly count row for template in the hour containing ts
+func (tdb *TemplateDB) InsertHourlyRow(uuid string, ts time.Time) error {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+
+	// Row already exists or is about to be written
+	currentHour := ts.UTC().Format(hourTimeFormat)
+	if tdb.cache.inserted[uuid] == currentHour {
+		return nil
+	}
+	tdb.cache.inserted[uuid] = currentHour
+
+	if w, ok := tdb.cache.hourly[uuid]; ok && currentHour > w.after {
+		if _, ok := w.counts[currentHour]; ok {
+			return nil
+		}
+		w.counts[currentHour] = 0
 	}
+	tdb.cache.dirty.hours[hourKey{uuid, currentHour}] += 0
 	return nil
 }
 
-// Increment count on template transition from template `prevId` to `uuid`
-func (tdb *TemplateDB) CountTransition(uuid string, podId string) error {
-	// Update prevId to next template id before returning
-	defer func() {
-		tdb.prevTidsMu.Lock()
-		tdb.prevTids[podId] = uuid
-		tdb.prevTidsMu.Unlock()
-	}()
-
-	prevTid := tdb.prevTids[podId]
+// Increment count on template transition from the previous template seen
+// in the same pod container to `uuid`, observed at event time ts
+func (tdb *TemplateDB) CountTransition(uuid string, meta common.K8sMetadata, ts time.Time) error {
+	// Swap in the new template id for the stream
+	tdb.prevTidsMu.Lock()
+	prevTid := tdb.prevTids.swap(streamKey(meta), uuid, ts)
+	tdb.prevTidsMu.Unlock()
 
 	// Ignore empty IDs
 	if len(prevTid) == 0 || len(uuid) == 0 {
 		return nil
 	}
 
-	tdb.prevTidsMu.RLock()
-	defer tdb.prevTidsMu.RUnlock()
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
 
-	_, err := tdb.db.Exec(`
-		INSERT OR IGNORE INTO template_transitions (src_template_id, dst_template_id, pod_id)
-		VALUES (?, ?, ?);
-	`, prevTid, uuid, podId)
+	g := groupOf(uuid, meta)
+	te, err := tdb.transitionsLocked(g)
 	if err != nil {
 		return err
 	}
+	te.srcs[prevTid]++
+	te.total++
 
-	_, err = tdb.db.Exec(`
-		UPDATE template_transitions
-		SET count = count + 1
-		WHERE src_template_id = ? AND dst_template_id = ? AND pod_id = ?
-	`, prevTid, uuid, podId)
+	k := transitionKey{srcTemplateID: prevTid, group: g}
+	tdb.cache.dirty.transitions[k] = tdb.cache.dirty.transitions[k].add(transitionDelta{
+		count:     1,
+		lastSeen:  ts.UTC().Format(TimestampFormat),
+		podName:   meta.PodName,
+		namespace: meta.Namespace,
+	})
 
-	if err != nil {
-		return err
+	return nil
+}
+
+// Transitions are tracked per pod container so that interleaved logs from
+// different workloads don't form bogus sequences
+func streamKey(meta common.K8sMetadata) string {
+	return meta.PodID + "/" + meta.ContainerName
+}
+
+// Last template seen in each stream, by stream key
+type prevTemplates map[string]prevTemplate
+
+type prevTemplate struct {
+	id       string
+	lastSeen time.Time // event time
+}
+
+// Make uuid the last template of the stream at event time ts and return the
+// one before it
+func (pt prevTemplates) swap(key string, uuid string, ts time.Time) string {
+	prev := pt[key]
+	if ts.Before(prev.lastSeen) {
+		ts = prev.lastSeen
+	}
+	pt[key] = prevTemplate{id: uuid, lastSeen: ts}
+	return prev.id
+}
+
+// Streams whose last template was merged continue from the survivor
+func (pt prevTemplates) rename(old string, survivor string) {
+	for key, prev := range pt {
+		if prev.id == old {
+			prev.id = survivor
+			pt[key] = prev
+		}
 	}
+}
 
-	return nil
+// Forget the streams not seen since before, their pods are gone.
+// Returns the number of streams forgotten
+func (pt prevTemplates) expire(before time.Time) int {
+	n := 0
+	for key, prev := range pt {
+		if prev.lastSeen.Before(before) {
+			delete(pt, key)
+			n++
+		}
+	}
+	return n
 }
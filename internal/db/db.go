@@ -24,109 +24,97 @@ func NewTemplateDB(dataSourceName string) (*TemplateDB, error) {
 	slog.Info("Connecting to template DB")
 	tdb := TemplateDB{}
 
-	// Open DB
-	dataSource := fmt.Sprintf("file:%s?cache=shared&_busy_timeout=5000&_journal_mode=WAL", dataSourceName)
-	db, err := sql.Open("sqlite", dataSource)
+	db, err := openDB(dataSourceName)
 	if err != nil {
 		return nil, err
 	}
 
-	// Enable WAL mode for better concurrency
-	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
-		return nil, err
-	}
-
 	tdb.db = db
 	slog.Info("Connected to template DB")
 
-	// Init tables
-	tdb.InitTables()
+	// Bring the schema up to date
+	if _, _, err := migrate(db, false); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	// Init prev TID map
-	tdb.prevTids = make(map[string]string)
+	tdb.prevTids = make(prevTemplates)
+
+	tdb.cache = newCounters(&tdb.mu)
 
 	return &tdb, nil
 }
 
-type TemplateDB struct {
-	db *sql.DB
+func openDB(dataSourceName string) (*sql.DB, error) {
+	dataSource := fmt.Sprintf("file:%s?cache=shared&_busy_timeout=5000&_journal_mode=WAL", dataSourceName)
+	db, err := sql.Open("sqlite", dataSource)
+	if err != nil {
+		return nil, err
+	}
 
-	prevTids   map[string]string // pod ID to prev Template ID
-	prevTidsMu sync.RWMutex
+	// Enable WAL mode for better concurrency
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-// Create DB tables if they don't exist
-func (tdb *TemplateDB) InitTables() error {
-	slog.Debug("Creating template tables...")
+var (
+	_ Store     = (*TemplateDB)(nil)
+	_ Persister = (*TemplateDB)(nil)
+)
 
-	_, err := tdb.db.Exec(`
-	CREATE TABLE IF NOT EXISTS templates(
-		uuid TEXT PRIMARY KEY,
-		token_count INTEGER NOT NULL,
-		template_text TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);`)
-	if err != nil {
-		return err
-	}
+// SQLite backed Store
+type TemplateDB struct {
+	db *sql.DB
 
-	_, err = tdb.db.Exec(`
-	CREATE TABLE IF NOT EXISTS template_transitions (
-		src_template_id TEXT NOT NULL,
-		dst_template_id TEXT NOT NULL,
-		pod_id TEXT NOT NULL,
-		count INTEGER NOT NULL DEFAULT 0,
-		last_seen TEXT DEFAULT CURRENT_TIMESTAMP,
+	prevTids   prevTemplates
+	prevTidsMu sync.RWMutex
 
-		PRIMARY KEY (src_template_id, dst_template_id, pod_id),
+	mu    sync.Mutex // guards cache
+	cache counters
 
-		FOREIGN KEY (src_template_id) REFERENCES templates(uuid),
-		FOREIGN KEY (dst_template_id) REFERENCES templates(uuid)
-	);`)
-	if err != nil {
-		return err
-	}
+	flushMu sync.Mutex // serializes flushes, merges, compactions and closing
+	closed  bool
+}
 
-	_, err = tdb.db.Exec(`
-	CREATE TABLE IF NOT EXISTS template_stats (
-		template_id TEXT PRIMARY KEY,
-		
-		-- Aggregated frequency over time
-		total_count INTEGER NOT NULL DEFAULT 0,
-		last_seen TEXT,
-		
-		-- Interarrival time statistics (in seconds)
-		iat_mean REAL NOT NULL DEFAULT 0.0,            -- mean interarrival time
-		iat_stddev REAL NOT NULL DEFAULT 0.0,          -- std dev of interarrival time
-		iat_last_timestamp TEXT,
-
-		FOREIGN KEY (template_id) REFERENCES templates(uuid)
-	);`)
-	if err != nil {
-		return err
-	}
+// Flush the counters and close the DB
+func (tdb *TemplateDB) Close() error {
+	flushErr := tdb.Flush()
 
-	_, err = tdb.db.Exec(`
-	CREATE TABLE IF NOT EXISTS template_hourly_counts (
-		template_id TEXT NOT NULL,
-		hour TEXT NOT NULL,         -- "2025-11-24 13"
-		count INTEGER NOT NULL DEFAULT 0,
+	tdb.flushMu.Lock()
+	defer tdb.flushMu.Unlock()
+	tdb.closed = true
+	return errors.Join(flushErr, tdb.db.Close())
+}
 
-		PRIMARY KEY (template_id, hour)
-	);`)
+// Write the WAL back into the DB file and truncate it
+func (tdb *TemplateDB) Checkpoint() error {
+	_, err := tdb.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+func (tdb *TemplateDB) SaveTemplate(t common.Template) error {
+	_, err := tdb.db.Exec(`
+		INSERT INTO templates (uuid, scope, token_count, template_text)
+		VALUES(?, ?, ?, ?)
+	`, t.ID, t.Scope, len(t.Tokens), strings.Join(t.Tokens, " "))
 	if err != nil {
 		return err
 	}
 
-	slog.Debug("All tables created successfully")
 	return nil
 }
 
-func (tdb *TemplateDB) SaveTemplate(t common.Template) error {
+// Store the generalized tokens of an existing template
+func (tdb *TemplateDB) UpdateTemplate(t common.Template) error {
 	_, err := tdb.db.Exec(`
-		INSERT INTO templates (uuid, token_count, template_text)
-		VALUES(?, ?, ?)
-	`, t.ID, len(t.Tokens), strings.Join(t.Tokens, " "))
+		UPDATE templates
+		SET token_count = ?, template_text = ?
+		WHERE uuid = ?
+	`, len(t.Tokens), strings.Join(t.Tokens, " "), t.ID)
 	if err != nil {
 		return err
 	}
@@ -136,9 +124,9 @@ func (tdb *TemplateDB) SaveTemplate(t common.Template) error {
 
 // Get all templates from DB and return a map of token count -> Templates
 func (tdb *TemplateDB) GetAllTemplates() (map[int][]common.Template, error) {
-	rows, err := tdb.db.Query("SELECT uuid, token_count, template_text FROM templates;")
+	rows, err := tdb.db.Query("SELECT uuid, scope, token_count, template_text FROM templates ORDER BY created_at, rowid;")
 	if err != nil {
-		return nil, sql.ErrConnDone
+		return nil, err
 	}
 
 	defer rows.Close()
@@ -146,10 +134,11 @@ func (tdb *TemplateDB) GetAllTemplates() (map[int][]common.Template, error) {
 	templates := make(map[int][]common.Template)
 	for rows.Next() {
 		var uuid string
+		var scope string
 		var token_count int
 		var template_text string
 
-		err := rows.Scan(&uuid, &token_count, &template_text)
+		err := rows.Scan(&uuid, &scope, &token_count, &template_text)
 		if err != nil {
 			slog.Error("Failed to read template row into vars")
 			continue
@@ -157,96 +146,208 @@ func (tdb *TemplateDB) GetAllTemplates() (map[int][]common.Template, error) {
 
 		t := common.Template{
 			ID:     uuid,
+			Scope:  scope,
 			Tokens: strings.Fields(template_text),
 		}
 		templates[token_count] = append(templates[token_count], t)
 	}
-	return templates, nil
+	return templates, rows.Err()
 }
 
-// Get mean and stddev of hourly counts from the past metricsLookbackHours hours
-func (tdb *TemplateDB) GetHourlyStats(tid string) (mean float64, stddev float64, err error) {
-	cutoff := time.Now().UTC().Add(-time.Hour * metricsLookbackHours)
-	row := tdb.db.QueryRow(`
-		SELECT AVG(count), SQRT(
-            (COUNT(count) * SUM(count * count) - (SUM(count) * SUM(count))) / ((COUNT(count) - 1) * COUNT(count))
-        ) AS stddev
-		FROM template_hourly_counts
-		WHERE template_id = ? AND hour > ?
-	`, tid, cutoff)
+// Get mean and stddev of hourly counts from the metricsLookbackHours hours
+// before event time ts, up to the hour of ts
+func (tdb *TemplateDB) GetHourlyStats(tid string, ts time.Time) (mean float64, stddev float64, err error) {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
 
-	var meanNull sql.NullFloat64
-	var stddevNull sql.NullFloat64
-	if err = row.Scan(&meanNull, &stddevNull); err != nil {
+	w, err := tdb.hourlyLocked(tid, ts)
+	if err != nil {
 		slog.Error("Failed to calculate mean and/or stddev of hourly counts")
 		return
 	}
 
-	mean = meanNull.Float64
-	stddev = stddevNull.Float64
+	mean, stddev = hourlyStats(w.counts, ts)
 	return
 }
 
-func (tdb *TemplateDB) GetCurrHourlyCount(tid string) (int, error) {
-	currentHour := time.Now().UTC().Format(hourTimeFormat)
-	row := tdb.db.QueryRow(`
-		SELECT count
-		FROM template_hourly_counts
-		WHERE template_id = ? AND hour = ?;
-	`, tid, currentHour)
+// Get count of the hour containing event time ts
+func (tdb *TemplateDB) GetHourlyCount(tid string, ts time.Time) (int, error) {
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
 
-	var count int
-	if err := row.Scan(&count); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return 0, nil
-		}
+	w, err := tdb.hourlyLocked(tid, ts)
+	if err != nil {
 		slog.Error("Failed to get current hourly count")
 		return 0, err
 	}
 
-	return count, nil
+	return w.counts[ts.UTC().Format(hourTimeFormat)], nil
 }
 
 // Get total count of transitions to tid and count of transitioning from prevTid to the give tid
-func (tdb *TemplateDB) GetTransitionCounts(tid string, podId string) (totalCount int, transitionCount int, err error) {
+// within the pod container described by meta
+func (tdb *TemplateDB) GetTransitionCounts(tid string, meta common.K8sMetadata) (totalCount int, transitionCount int, err error) {
 	tdb.prevTidsMu.RLock()
-	defer tdb.prevTidsMu.RUnlock()
-
-	prevTid, ok := tdb.prevTids[podId]
+	prev, ok := tdb.prevTids[streamKey(meta)]
+	tdb.prevTidsMu.RUnlock()
 
 	// No prev tid yet
 	if !ok {
 		return 0, 0, nil
 	}
 
-	row := tdb.db.QueryRow(`
-		SELECT 
-			COUNT(CASE WHEN src_template_id = ? AND dst_template_id = ? AND pod_id = ? THEN 1 END)
-		FROM template_transitions;
-	`, prevTid, tid, podId)
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
 
-	var tran sql.NullInt32
-	if err := row.Scan(&tran); err != nil {
+	te, err := tdb.transitionsLocked(groupOf(tid, meta))
+	if err != nil {
 		return 0, 0, err
 	}
 
-	row = tdb.db.QueryRow(`
-		SELECT
-			COUNT(CASE WHEN dst_template_id = ? AND pod_id = ? THEN 1 END)
-		FROM template_transitions;
-	`, tid, podId)
-	var total sql.NullInt32
-	if err := row.Scan(&total); err != nil {
-		return 0, 0, err
+	return te.total, te.srcs[prev.id], nil
+}
+
+type TemplateStats struct {
+	TemplateID string
+	TotalCount int
+	LastSeen   time.Time
+	IATMean    float64
+	IATStddev  float64
+}
+
+// Get count and IAT stats of every template that has been counted
+func (tdb *TemplateDB) GetAllTemplateStats() ([]TemplateStats, error) {
+	rows, err := tdb.db.Query(`
+		SELECT template_id, total_count, last_seen, iat_mean, iat_stddev
+		FROM template_stats
+		WHERE last_seen IS NOT NULL;
+	`)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	if tran.Valid && total.Valid {
-		transitionCount = int(tran.Int32)
-		totalCount = int(tran.Int32)
-	} else {
-		// query is NULL when no such transition recorded yet
-		return 0, 0, nil
+	var stats []TemplateStats
+	for rows.Next() {
+		var ts TemplateStats
+		var lastSeen string
+		if err := rows.Scan(&ts.TemplateID, &ts.TotalCount, &lastSeen, &ts.IATMean, &ts.IATStddev); err != nil {
+			slog.Error("Failed to read template stats row into vars")
+			continue
+		}
+
+		ts.LastSeen, err = time.Parse(TimestampFormat, lastSeen)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Failed to parse last seen timestamp of template %s", ts.TemplateID))
+			continue
+		}
+		stats = append(stats, ts)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return
+	// Counters in memory are ahead of the DB
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+
+	seen := make(map[string]bool, len(stats))
+	for i := range stats {
+		seen[stats[i].TemplateID] = true
+		if st := tdb.cache.stats[stats[i].TemplateID]; st != nil {
+			stats[i].TotalCount, stats[i].IATMean, stats[i].IATStddev = st.count, st.mean, st.stddev
+			if lastSeen, err := time.Parse(TimestampFormat, st.lastSeen); err == nil {
+				stats[i].LastSeen = lastSeen
+			}
+		}
+	}
+	for uuid, st := range tdb.cache.stats {
+		if st == nil || seen[uuid] || st.lastSeen == "" {
+			continue
+		}
+		lastSeen, err := time.Parse(TimestampFormat, st.lastSeen)
+		if err != nil {
+			continue
+		}
+		stats = append(stats, TemplateStats{
+			TemplateID: uuid,
+			TotalCount: st.count,
+			LastSeen:   lastSeen,
+			IATMean:    st.mean,
+			IATStddev:  st.stddev,
+		})
+	}
+	return stats, nil
+}
+
+type TemplateCount struct {
+	TemplateID string
+	Scope      string
+	Text       string
+	TotalCount int
+}
+
+// Get every template with its total count, most frequent first.
+// Pending counters are flushed first
+func (tdb *TemplateDB) GetTemplateCounts() ([]TemplateCount, error) {
+	if err := tdb.Flush(); err != nil {
+		return nil, err
+	}
+
+	rows, err := tdb.db.Query(`
+		SELECT t.uuid, t.scope, t.template_text, COALESCE(s.total_count, 0) AS total
+		FROM templates t
+		LEFT JOIN template_stats s ON s.template_id = t.uuid
+		ORDER BY total DESC, t.template_text;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []TemplateCount
+	for rows.Next() {
+		var tc TemplateCount
+		if err := rows.Scan(&tc.TemplateID, &tc.Scope, &tc.Text, &tc.TotalCount); err != nil {
+			slog.Error("Failed to read template count row into vars")
+			continue
+		}
+		counts = append(counts, tc)
+	}
+	return counts, rows.Err()
+}
+
+type CrossScopeCount struct {
+	Text       string
+	ScopeCount int
+	TotalCount int
+}
+
+// Get template counts summed over all scopes, most frequent first.
+// Pending counters are flushed first
+func (tdb *TemplateDB) GetCrossScopeCounts() ([]CrossScopeCount, error) {
+	if err := tdb.Flush(); err != nil {
+		return nil, err
+	}
+
+	rows, err := tdb.db.Query(`
+		SELECT template_text, scope_count, total_count
+		FROM template_totals
+		ORDER BY total_count DESC, template_text;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []CrossScopeCount
+	for rows.Next() {
+		var cc CrossScopeCount
+		if err := rows.Scan(&cc.Text, &cc.ScopeCount, &cc.TotalCount); err != nil {
+			slog.Error("Failed to read cross-scope count row into vars")
+			continue
+		}
+		counts = append(counts, cc)
+	}
+	return counts, rows.Err()
 }
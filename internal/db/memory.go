@@ -0,0 +1,388 @@
+package db
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	common "log-analyzer/internal/common"
+)
+
+// Streams of a MemoryStore not seen for this long are forgotten, like the
+// default retention of gone pods
+const memoryStreamIdleTimeout = 7 * 24 * time.Hour
+
+// Store keeping everything in memory, for throwaway runs and tests.
+// Nothing survives Close
+type MemoryStore struct {
+	mu sync.Mutex
+
+	templates map[string]*memoryTemplate
+	created   int // creation order of the next template
+
+	stats       map[string]*statsEntry
+	hourly      map[string]map[string]int // template ID to hour to count
+	transitions map[transitionGroup]*transitionEntries
+	prevTids    prevTemplates
+	expiredAt   time.Time // event time streams were last expired at
+}
+
+type memoryTemplate struct {
+	tmpl    common.Template
+	created int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		templates:   make(map[string]*memoryTemplate),
+		stats:       make(map[string]*statsEntry),
+		hourly:      make(map[string]map[string]int),
+		transitions: make(map[transitionGroup]*transitionEntries),
+		prevTids:    make(prevTemplates),
+	}
+}
+
+func (ms *MemoryStore) SaveTemplate(t common.Template) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.templates[t.ID] = &memoryTemplate{tmpl: storedTemplate(t), created: ms.created}
+	ms.created++
+	return nil
+}
+
+// Store the generalized tokens of an existing template
+func (ms *MemoryStore) UpdateTemplate(t common.Template) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mt, ok := ms.templates[t.ID]; ok {
+		mt.tmpl.Tokens = slices.Clone(t.Tokens)
+	}
+	return nil
+}
+
+// Only the fields the SQLite store keeps are stored
+func storedTemplate(t common.Template) common.Template {
+	return common.Template{ID: t.ID, Scope: t.Scope, Tokens: slices.Clone(t.Tokens)}
+}
+
+// Merge the templates with ids merged into survivor, folding their counters
+// into the survivor's
+func (ms *MemoryStore) MergeTemplates(survivor common.Template, merged []string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mt, ok := ms.templates[survivor.ID]; ok {
+		mt.tmpl.Tokens = slices.Clone(survivor.Tokens)
+	}
+
+	for _, old := range merged {
+		if old == survivor.ID {
+			continue
+		}
+
+		if from := ms.stats[old]; from != nil {
+			into := ms.stats[survivor.ID]
+			if into == nil {
+				into = &statsEntry{}
+				ms.stats[survivor.ID] = into
+			}
+			into.mean, into.stddev = poolIAT(
+				float64(into.count), into.mean, into.stddev,
+				float64(from.count), from.mean, from.stddev,
+			)
+			into.count += from.count
+			into.lastSeen = max(into.lastSeen, from.lastSeen)
+			into.iatLastTs = max(into.iatLastTs, from.iatLastTs)
+			delete(ms.stats, old)
+		}
+
+		if hours, ok := ms.hourly[old]; ok {
+			into := ms.hourly[survivor.ID]
+			if into == nil {
+				into = make(map[string]int)
+				ms.hourly[survivor.ID] = into
+			}
+			for hour, n := range hours {
+				into[hour] += n
+			}
+			delete(ms.hourly, old)
+		}
+
+		ms.mergeTransitions(survivor.ID, old)
+		delete(ms.templates, old)
+
+		ms.prevTids.rename(old, survivor.ID)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) mergeTransitions(survivor string, old string) {
+	rename := func(tid string) string {
+		if tid == old {
+			return survivor
+		}
+		return tid
+	}
+
+	for g, te := range ms.transitions {
+		_, fromOld := te.srcs[old]
+		if g.dstTemplateID != old && !fromOld {
+			continue
+		}
+		delete(ms.transitions, g)
+
+		g.dstTemplateID = rename(g.dstTemplateID)
+		into := ms.transitions[g]
+		if into == nil {
+			into = &transitionEntries{srcs: make(map[string]int)}
+			ms.transitions[g] = into
+		}
+		for src, n := range te.srcs {
+			into.srcs[rename(src)] += n
+			into.total += n
+		}
+	}
+}
+
+// Get all templates and return a map of token count -> Templates, oldest first
+func (ms *MemoryStore) GetAllTemplates() (map[int][]common.Template, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	all := make([]*memoryTemplate, 0, len(ms.templates))
+	for _, mt := range ms.templates {
+		all = append(all, mt)
+	}
+	slices.SortFunc(all, func(a, b *memoryTemplate) int {
+		return cmp.Compare(a.created, b.created)
+	})
+
+	templates := make(map[int][]common.Template)
+	for _, mt := range all {
+		t := storedTemplate(mt.tmpl)
+		templates[len(t.Tokens)] = append(templates[len(t.Tokens)], t)
+	}
+	return templates, nil
+}
+
+// Update template count stat for an occurrence at event time ts
+func (ms *MemoryStore) CountTemplate(uuid string, ts time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	st := ms.stats[uuid]
+	if st == nil {
+		st = &statsEntry{}
+		ms.stats[uuid] = st
+	}
+
+	newMean, newStddev, inOrder, err := calculateIAT(st.iatLastTs, st.mean, st.stddev, st.count, ts)
+	if err != nil {
+		return err
+	}
+
+	st.count++
+	if inOrder {
+		currTs := ts.UTC().Format(TimestampFormat)
+		st.lastSeen, st.iatLastTs = currTs, currTs
+		st.mean, st.stddev = newMean, newStddev
+	}
+	return nil
+}
+
+// Update hourly count for template in the hour containing event time ts
+func (ms *MemoryStore) CountTemplateHourly(uuid string, ts time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.hours(uuid)[ts.UTC().Format(hourTimeFormat)]++
+	return nil
+}
+
+// Add a zero hourly count for template in the hour containing ts
+func (ms *MemoryStore) InsertHourlyRow(uuid string, ts time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.hours(uuid)[ts.UTC().Format(hourTimeFormat)] += 0
+	return nil
+}
+
+func (ms *MemoryStore) hours(uuid string) map[string]int {
+	hours, ok := ms.hourly[uuid]
+	if !ok {
+		hours = make(map[string]int)
+		ms.hourly[uuid] = hours
+	}
+	return hours
+}
+
+// Increment count on template transition from the previous template seen
+// in the same pod container to `uuid`
+func (ms *MemoryStore) CountTransition(uuid string, meta common.K8sMetadata, ts time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	prevTid := ms.prevTids.swap(streamKey(meta), uuid, ts)
+	ms.expireStreams(ts)
+	if len(prevTid) == 0 || len(uuid) == 0 {
+		return nil
+	}
+
+	g := groupOf(uuid, meta)
+	te, ok := ms.transitions[g]
+	if !ok {
+		te = &transitionEntries{srcs: make(map[string]int)}
+		ms.transitions[g] = te
+	}
+	te.srcs[prevTid]++
+	te.total++
+	return nil
+}
+
+// Fetch IAT stats for uuid, ErrNotCounted if it has never been counted
+func (ms *MemoryStore) GetIATStats(uuid string) (count int, mean float64, stddev float64, lastTs string, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	st := ms.stats[uuid]
+	if st == nil {
+		return 0, 0, 0, "", ErrNotCounted
+	}
+	return st.count, st.mean, st.stddev, st.iatLastTs, nil
+}
+
+// Get mean and stddev of hourly counts from the metricsLookbackHours hours
+// before event time ts, up to the hour of ts
+func (ms *MemoryStore) GetHourlyStats(tid string, ts time.Time) (mean float64, stddev float64, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mean, stddev = hourlyStats(ms.hourly[tid], ts)
+	return
+}
+
+// Get count of the hour containing event time ts
+func (ms *MemoryStore) GetHourlyCount(tid string, ts time.Time) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.hourly[tid][ts.UTC().Format(hourTimeFormat)], nil
+}
+
+// Get total count of transitions to tid and count of transitioning from the
+// previous template to tid within the pod container described by meta
+func (ms *MemoryStore) GetTransitionCounts(tid string, meta common.K8sMetadata) (totalCount int, transitionCount int, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	prev, ok := ms.prevTids[streamKey(meta)]
+	if !ok {
+		return 0, 0, nil
+	}
+
+	te, ok := ms.transitions[groupOf(tid, meta)]
+	if !ok {
+		return 0, 0, nil
+	}
+	return te.total, te.srcs[prev.id], nil
+}
+
+// Forget streams idle for memoryStreamIdleTimeout at event time ts, at most
+// once per hour of event time. Nothing compacts a MemoryStore, pods come and
+// go and their streams would pile up otherwise
+func (ms *MemoryStore) expireStreams(ts time.Time) {
+	if ts.Sub(ms.expiredAt) < time.Hour {
+		return
+	}
+	ms.expiredAt = ts
+	ms.prevTids.expire(ts.Add(-memoryStreamIdleTimeout))
+}
+
+// Get count and IAT stats of every template that has been counted
+func (ms *MemoryStore) GetAllTemplateStats() ([]TemplateStats, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var stats []TemplateStats
+	for uuid, st := range ms.stats {
+		lastSeen, err := time.Parse(TimestampFormat, st.lastSeen)
+		if err != nil {
+			continue
+		}
+		stats = append(stats, TemplateStats{
+			TemplateID: uuid,
+			TotalCount: st.count,
+			LastSeen:   lastSeen,
+			IATMean:    st.mean,
+			IATStddev:  st.stddev,
+		})
+	}
+	return stats, nil
+}
+
+// Get every template with its total count, most frequent first
+func (ms *MemoryStore) GetTemplateCounts() ([]TemplateCount, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	counts := make([]TemplateCount, 0, len(ms.templates))
+	for uuid, mt := range ms.templates {
+		tc := TemplateCount{
+			TemplateID: uuid,
+			Scope:      mt.tmpl.Scope,
+			Text:       strings.Join(mt.tmpl.Tokens, " "),
+		}
+		if st := ms.stats[uuid]; st != nil {
+			tc.TotalCount = st.count
+		}
+		counts = append(counts, tc)
+	}
+	slices.SortFunc(counts, func(a, b TemplateCount) int {
+		return cmp.Or(cmp.Compare(b.TotalCount, a.TotalCount), cmp.Compare(a.Text, b.Text))
+	})
+	return counts, nil
+}
+
+// Get template counts summed over all scopes, most frequent first
+func (ms *MemoryStore) GetCrossScopeCounts() ([]CrossScopeCount, error) {
+	counts, err := ms.GetTemplateCounts()
+	if err != nil {
+		return nil, err
+	}
+
+	byText := make(map[string]*CrossScopeCount)
+	scopes := make(map[string]map[string]bool)
+	var totals []*CrossScopeCount
+	for _, tc := range counts {
+		cc, ok := byText[tc.Text]
+		if !ok {
+			cc = &CrossScopeCount{Text: tc.Text}
+			byText[tc.Text] = cc
+			scopes[tc.Text] = make(map[string]bool)
+			totals = append(totals, cc)
+		}
+		cc.TotalCount += tc.TotalCount
+		scopes[tc.Text][tc.Scope] = true
+		cc.ScopeCount = len(scopes[tc.Text])
+	}
+
+	result := make([]CrossScopeCount, 0, len(totals))
+	for _, cc := range totals {
+		result = append(result, *cc)
+	}
+	slices.SortFunc(result, func(a, b CrossScopeCount) int {
+		return cmp.Or(cmp.Compare(b.TotalCount, a.TotalCount), cmp.Compare(a.Text, b.Text))
+	})
+	return result, nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+var _ Store = (*MemoryStore)(nil)
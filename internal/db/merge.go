@@ -0,0 +1,261 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	common "log-analyzer/internal/common"
+)
+
+// Merge the templates with ids merged into survivor.
+// Stats, hourly counts and transitions of the merged templates are folded
+// into the survivor, the merged templates are deleted and a lineage record
+// maps each of them to the survivor.
+func (tdb *TemplateDB) MergeTemplates(survivor common.Template, merged []string) error {
+	// Counting waits for the merge, the pending counters are written in the
+	// same transaction and the cached counters of the templates are reloaded
+	tdb.flushMu.Lock()
+	defer tdb.flushMu.Unlock()
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+
+	p := tdb.takePendingLocked()
+	committed := false
+	defer func() {
+		if !committed {
+			tdb.cache.dirty.restore(p)
+		}
+		tdb.cache.flushing = false
+	}()
+
+	tx, err := tdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := writePending(tx, p); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE templates
+		SET token_count = ?, template_text = ?
+		WHERE uuid = ?
+	`, len(survivor.Tokens), strings.Join(survivor.Tokens, " "), survivor.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update survivor template: %s", err)
+	}
+
+	for _, old := range merged {
+		if old == survivor.ID {
+			continue
+		}
+		if err := mergeStats(tx, survivor.ID, old); err != nil {
+			return fmt.Errorf("failed to merge stats of %s: %s", old, err)
+		}
+		if err := mergeHourlyCounts(tx, survivor.ID, old); err != nil {
+			return fmt.Errorf("failed to merge hourly counts of %s: %s", old, err)
+		}
+		if err := mergeTransitions(tx, survivor.ID, old); err != nil {
+			return fmt.Errorf("failed to merge transitions of %s: %s", old, err)
+		}
+		if err := recordLineage(tx, survivor.ID, old); err != nil {
+			return fmt.Errorf("failed to record lineage of %s: %s", old, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	tdb.invalidateLocked(append([]string{survivor.ID}, merged...))
+
+	// Streams whose last template was merged continue from the survivor
+	tdb.prevTidsMu.Lock()
+	for _, old := range merged {
+		tdb.prevTids.rename(old, survivor.ID)
+	}
+	tdb.prevTidsMu.Unlock()
+
+	return nil
+}
+
+type iatStats struct {
+	count     int
+	lastSeen  sql.NullString
+	mean      float64
+	stddev    float64
+	lastIATTs sql.NullString
+	recorded  bool
+}
+
+func getStats(tx *sql.Tx, uuid string) (iatStats, error) {
+	var st iatStats
+	err := tx.QueryRow(`
+		SELECT total_count, last_seen, iat_mean, iat_stddev, iat_last_timestamp
+		FROM template_stats
+		WHERE template_id = ?;
+	`, uuid).Scan(&st.count, &st.lastSeen, &st.mean, &st.stddev, &st.lastIATTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return st, nil
+	}
+	st.recorded = err == nil
+	return st, err
+}
+
+// Combine the stats rows of both templates, pooling the IAT mean and
+// variance of both populations
+func mergeStats(tx *sql.Tx, survivor string, old string) error {
+	from, err := getStats(tx, old)
+	if err != nil || !from.recorded {
+		return err
+	}
+	into, err := getStats(tx, survivor)
+	if err != nil {
+		return err
+	}
+
+	mean, stddev := poolIAT(
+		float64(into.count), into.mean, into.stddev,
+		float64(from.count), from.mean, from.stddev,
+	)
+
+	_, err = tx.Exec(`
+		INSERT INTO template_stats
+			(template_id, total_count, last_seen, iat_mean, iat_stddev, iat_last_timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (template_id) DO UPDATE SET
+			total_count = excluded.total_count,
+			last_seen = excluded.last_seen,
+			iat_mean = excluded.iat_mean,
+			iat_stddev = excluded.iat_stddev,
+			iat_last_timestamp = excluded.iat_last_timestamp;
+	`, survivor, into.count+from.count, maxTimestamp(into.lastSeen, from.lastSeen),
+		mean, stddev, maxTimestamp(into.lastIATTs, from.lastIATTs))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM template_stats WHERE template_id = ?;`, old)
+	return err
+}
+
+func maxTimestamp(a, b sql.NullString) sql.NullString {
+	if !a.Valid || (b.Valid && b.String > a.String) {
+		return b
+	}
+	return a
+}
+
+func mergeHourlyCounts(tx *sql.Tx, survivor string, old string) error {
+	_, err := tx.Exec(`
+		INSERT INTO template_hourly_counts (template_id, hour, count)
+		SELECT ?, hour, count
+		FROM template_hourly_counts
+		WHERE template_id = ?
+		ON CONFLICT (template_id, hour) DO UPDATE SET
+			count = count + excluded.count;
+	`, survivor, old)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM template_hourly_counts WHERE template_id = ?;`, old)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO template_daily_counts (template_id, day, count, hours)
+		SELECT ?, day, count, hours
+		FROM template_daily_counts
+		WHERE template_id = ?
+		ON CONFLICT (template_id, day) DO UPDATE SET
+			count = count + excluded.count,
+			hours = hours + excluded.hours;
+	`, survivor, old)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM template_daily_counts WHERE template_id = ?;`, old)
+	return err
+}
+
+func mergeTransitions(tx *sql.Tx, survivor string, old string) error {
+	_, err := tx.Exec(`
+		INSERT INTO template_transitions
+			(src_template_id, dst_template_id, pod_id, container_name, pod_name, namespace, count, last_seen)
+		SELECT
+			CASE WHEN src_template_id = ?2 THEN ?1 ELSE src_template_id END,
+			CASE WHEN dst_template_id = ?2 THEN ?1 ELSE dst_template_id END,
+			pod_id, container_name, pod_name, namespace, count, last_seen
+		FROM template_transitions
+		WHERE src_template_id = ?2 OR dst_template_id = ?2
+		ON CONFLICT (src_template_id, dst_template_id, pod_id, container_name) DO UPDATE SET
+			count = count + excluded.count,
+			last_seen = MAX(last_seen, excluded.last_seen);
+	`, survivor, old)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM template_transitions
+		WHERE src_template_id = ? OR dst_template_id = ?;
+	`, old, old)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO template_workload_transitions
+			(src_template_id, dst_template_id, namespace, container_name, count, last_seen)
+		SELECT
+			CASE WHEN src_template_id = ?2 THEN ?1 ELSE src_template_id END,
+			CASE WHEN dst_template_id = ?2 THEN ?1 ELSE dst_template_id END,
+			namespace, container_name, count, last_seen
+		FROM template_workload_transitions
+		WHERE src_template_id = ?2 OR dst_template_id = ?2
+		ON CONFLICT (src_template_id, dst_template_id, namespace, container_name) DO UPDATE SET
+			count = count + excluded.count,
+			last_seen = MAX(last_seen, excluded.last_seen);
+	`, survivor, old)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM template_workload_transitions
+		WHERE src_template_id = ? OR dst_template_id = ?;
+	`, old, old)
+	return err
+}
+
+func recordLineage(tx *sql.Tx, survivor string, old string) error {
+	_, err := tx.Exec(`
+		INSERT OR REPLACE INTO template_lineage (old_template_id, new_template_id, old_template_text)
+		SELECT uuid, ?, template_text
+		FROM templates
+		WHERE uuid = ?;
+	`, survivor, old)
+	if err != nil {
+		return err
+	}
+
+	// Templates merged into old before now map to the survivor
+	_, err = tx.Exec(`
+		UPDATE template_lineage
+		SET new_template_id = ?
+		WHERE new_template_id = ?;
+	`, survivor, old)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM templates WHERE uuid = ?;`, old)
+	return err
+}
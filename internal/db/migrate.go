@@ -0,0 +1,212 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Up-migration of the template DB schema, from migrations/<version>_<name>.sql
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Returned when the DB was migrated by a newer build
+type NewerSchemaError struct {
+	Version int
+	Latest  int
+}
+
+func (e *NewerSchemaError) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than the latest known version %d, upgrade log-analyzer", e.Version, e.Latest)
+}
+
+// Get all migrations ordered by version
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		num, label, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", e.Name())
+		}
+
+		b, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: label, SQL: string(b)})
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate the DB file to the latest schema version, or only report what
+// would be done if dryRun. A dry run opens the DB read-only and fails if it
+// doesn't exist.
+// Returns the version the DB was at and the migrations applied
+func Migrate(dataSourceName string, dryRun bool) (int, []Migration, error) {
+	open := openDB
+	if dryRun {
+		open = openReadOnly
+	}
+	conn, err := open(dataSourceName)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	return migrate(conn, dryRun)
+}
+
+// Open an existing DB file without creating it or changing its journal mode
+func openReadOnly(dataSourceName string) (*sql.DB, error) {
+	if _, err := os.Stat(dataSourceName); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", dataSourceName))
+}
+
+func migrate(conn *sql.DB, dryRun bool) (int, []Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, nil, err
+	}
+	latest := len(migrations)
+
+	version, err := schemaVersion(conn)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read schema version: %s", err)
+	}
+	if version > latest {
+		return version, nil, &NewerSchemaError{Version: version, Latest: latest}
+	}
+
+	pending := migrations[version:]
+	if dryRun {
+		return version, pending, nil
+	}
+
+	if _, err := conn.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TEXT DEFAULT CURRENT_TIMESTAMP
+		);
+	`); err != nil {
+		return version, nil, err
+	}
+
+	// Databases from before versioning are stamped with the migrations
+	// their schema already has
+	if err := stampVersion(conn, migrations[:version]); err != nil {
+		return version, nil, fmt.Errorf("failed to record schema version %d: %s", version, err)
+	}
+
+	for i, m := range pending {
+		slog.Info(fmt.Sprintf("Migrating template DB to version %d (%s)", m.Version, m.Name))
+		if err := applyMigration(conn, m); err != nil {
+			return version, pending[:i], fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+	return version, pending, nil
+}
+
+func applyMigration(conn *sql.DB, m Migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name) VALUES (?, ?);`, m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func stampVersion(conn *sql.DB, applied []Migration) error {
+	for _, m := range applied {
+		_, err := conn.Exec(`INSERT OR IGNORE INTO schema_version (version, name) VALUES (?, ?);`, m.Version, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the schema version of the DB, 0 for an empty DB
+func schemaVersion(conn *sql.DB) (int, error) {
+	versioned, err := hasTable(conn, "schema_version")
+	if err != nil {
+		return 0, err
+	}
+	if versioned {
+		var version sql.NullInt64
+		err := conn.QueryRow(`SELECT MAX(version) FROM schema_version;`).Scan(&version)
+		return int(version.Int64), err
+	}
+	return legacyVersion(conn)
+}
+
+// Version of a DB created before schema versioning. Builds before it
+// changed the schema in place at startup, so such a DB may have stopped at
+// the schema of any of migrations 1 to 4. Each probe checks for the change
+// of one of them, in order. Later migrations postdate versioning and need no
+// probe
+func legacyVersion(conn *sql.DB) (int, error) {
+	probes := []func() (bool, error){
+		func() (bool, error) { return hasTable(conn, "templates") },
+		func() (bool, error) { return hasColumn(conn, "template_transitions", "container_name") },
+		func() (bool, error) { return hasTable(conn, "template_lineage") },
+		func() (bool, error) { return hasColumn(conn, "templates", "scope") },
+	}
+
+	version := 0
+	for _, probe := range probes {
+		ok, err := probe()
+		if err != nil || !ok {
+			return version, err
+		}
+		version++
+	}
+	return version, nil
+}
+
+func hasTable(conn *sql.DB, table string) (bool, error) {
+	var n int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, table).Scan(&n)
+	return n > 0, err
+}
+
+func hasColumn(conn *sql.DB, table string, column string) (bool, error) {
+	var n int
+	err := conn.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?;`, table, column).Scan(&n)
+	return n > 0, err
+}
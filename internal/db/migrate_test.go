@@ -0,0 +1,225 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	common "log-analyzer/internal/common"
+)
+
+// Create a DB file with the schema of the given migrations only
+func seedDB(t *testing.T, version int, seed string) string {
+	t.Helper()
+
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "data.db")
+	conn, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, m := range migrations[:version] {
+		if _, err := conn.Exec(m.SQL); err != nil {
+			t.Fatalf("migration %d: %s", m.Version, err)
+		}
+	}
+	if _, err := conn.Exec(seed); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMigrateBaselineTransitions(t *testing.T) {
+	path := seedDB(t, 1, `
+		INSERT INTO templates (uuid, token_count, template_text) VALUES
+			('a', 1, 'a'), ('b', 1, 'b');
+		INSERT INTO template_transitions (src_template_id, dst_template_id, pod_id, count, last_seen) VALUES
+			('a', 'b', 'pod-1', 3, '2025-11-24 13:00:00'),
+			('b', 'a', 'pod-1', 2, '2025-11-24 13:00:01');
+	`)
+
+	tdb, err := NewTemplateDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+
+	// Rows keep their counts under the new primary key
+	var rows, total int
+	err = tdb.db.QueryRow(`
+		SELECT COUNT(*), SUM(count) FROM template_transitions WHERE container_name = '';
+	`).Scan(&rows, &total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 || total != 5 {
+		t.Fatalf("got %d rows with count %d, want 2 rows with count 5", rows, total)
+	}
+
+	// Counting upserts into the rebuilt table
+	meta := common.K8sMetadata{PodID: "pod-1"}
+	ts := time.Date(2025, 11, 24, 14, 0, 0, 0, time.UTC)
+	for _, tid := range []string{"a", "b"} {
+		if err := tdb.CountTransition(tid, meta, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tdb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = tdb.db.QueryRow(`
+		SELECT count FROM template_transitions
+		WHERE src_template_id = 'a' AND dst_template_id = 'b' AND pod_id = 'pod-1' AND container_name = '';
+	`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Fatalf("got transition count %d, want 4", count)
+	}
+}
+
+func TestMigrateTemplateScope(t *testing.T) {
+	path := seedDB(t, 3, `
+		INSERT INTO templates (uuid, token_count, template_text) VALUES ('a', 2, 'user <NUM>');
+	`)
+
+	tdb, err := NewTemplateDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+
+	err = tdb.SaveTemplate(common.Template{ID: "b", Scope: "shop/api", Tokens: []string{"order", "<NUM>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := tdb.GetAllTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := templates[2]
+	if len(got) != 2 || got[0].ID != "a" || got[0].Scope != "" || got[1].ID != "b" || got[1].Scope != "shop/api" {
+		t.Fatalf("got templates %+v, want a in the global scope and b in shop/api", got)
+	}
+}
+
+func TestMigrateLegacyVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+	}{
+		{"empty", 0},
+		{"baseline", 1},
+		{"transition workload", 2},
+		{"template lineage", 3},
+		{"template scope", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := seedDB(t, tt.version, "")
+
+			conn, err := openDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			version, applied, err := migrate(conn, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.version {
+				t.Fatalf("got version %d, want %d", version, tt.version)
+			}
+
+			migrations, _ := Migrations()
+			if len(applied) != len(migrations)-tt.version {
+				t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations)-tt.version)
+			}
+
+			// Stamped and up to date
+			version, applied, err = migrate(conn, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != len(migrations) || len(applied) != 0 {
+				t.Fatalf("got version %d with %d pending, want %d with none", version, len(applied), len(migrations))
+			}
+		})
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	path := seedDB(t, 0, `
+		CREATE TABLE schema_version (version INTEGER PRIMARY KEY, name TEXT NOT NULL);
+		INSERT INTO schema_version (version, name) VALUES (999, 'future');
+	`)
+
+	_, err := NewTemplateDB(path)
+	if _, ok := err.(*NewerSchemaError); !ok {
+		t.Fatalf("got error %v, want NewerSchemaError", err)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "data.db")
+		if _, _, err := Migrate(path, true); err == nil {
+			t.Fatal("dry run of a missing DB succeeded")
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("dry run created %s", path)
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		// In rollback journal mode, which a dry run must leave as is
+		path := filepath.Join(t.TempDir(), "data.db")
+		conn, err := sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migrations, _ := Migrations()
+		if _, err := conn.Exec(migrations[0].SQL); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		version, pending, err := Migrate(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 1 || len(pending) != len(migrations)-1 {
+			t.Fatalf("got version %d with %d pending, want 1 with %d", version, len(pending), len(migrations)-1)
+		}
+
+		conn, err = sql.Open("sqlite", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var mode string
+		if err := conn.QueryRow(`PRAGMA journal_mode;`).Scan(&mode); err != nil {
+			t.Fatal(err)
+		}
+		if mode != "delete" {
+			t.Fatalf("got journal mode %s after a dry run, want delete", mode)
+		}
+		if versioned, _ := hasTable(conn, "schema_version"); versioned {
+			t.Fatal("dry run stamped the schema version")
+		}
+	})
+}
@@ -0,0 +1,43 @@
+-- Schema of databases created before schema versioning
+CREATE TABLE IF NOT EXISTS templates(
+	uuid TEXT PRIMARY KEY,
+	token_count INTEGER NOT NULL,
+	template_text TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS template_transitions (
+	src_template_id TEXT NOT NULL,
+	dst_template_id TEXT NOT NULL,
+	pod_id TEXT NOT NULL,
+	count INTEGER NOT NULL DEFAULT 0,
+	last_seen TEXT DEFAULT CURRENT_TIMESTAMP,
+
+	PRIMARY KEY (src_template_id, dst_template_id, pod_id),
+
+	FOREIGN KEY (src_template_id) REFERENCES templates(uuid),
+	FOREIGN KEY (dst_template_id) REFERENCES templates(uuid)
+);
+
+CREATE TABLE IF NOT EXISTS template_stats (
+	template_id TEXT PRIMARY KEY,
+
+	-- Aggregated frequency over time
+	total_count INTEGER NOT NULL DEFAULT 0,
+	last_seen TEXT,
+
+	-- Interarrival time statistics (in seconds)
+	iat_mean REAL NOT NULL DEFAULT 0.0,            -- mean interarrival time
+	iat_stddev REAL NOT NULL DEFAULT 0.0,          -- std dev of interarrival time
+	iat_last_timestamp TEXT,
+
+	FOREIGN KEY (template_id) REFERENCES templates(uuid)
+);
+
+CREATE TABLE IF NOT EXISTS template_hourly_counts (
+	template_id TEXT NOT NULL,
+	hour TEXT NOT NULL,         -- "2025-11-24 13"
+	count INTEGER NOT NULL DEFAULT 0,
+
+	PRIMARY KEY (template_id, hour)
+);
@@ -0,0 +1,24 @@
+-- Track transitions per pod container and keep the workload they were seen in.
+-- The primary key changes, so the table is rebuilt
+CREATE TABLE template_transitions_new (
+	src_template_id TEXT NOT NULL,
+	dst_template_id TEXT NOT NULL,
+	pod_id TEXT NOT NULL,
+	container_name TEXT NOT NULL DEFAULT '',
+	pod_name TEXT NOT NULL DEFAULT '',
+	namespace TEXT NOT NULL DEFAULT '',
+	count INTEGER NOT NULL DEFAULT 0,
+	last_seen TEXT DEFAULT CURRENT_TIMESTAMP,
+
+	PRIMARY KEY (src_template_id, dst_template_id, pod_id, container_name),
+
+	FOREIGN KEY (src_template_id) REFERENCES templates(uuid),
+	FOREIGN KEY (dst_template_id) REFERENCES templates(uuid)
+);
+
+INSERT INTO template_transitions_new (src_template_id, dst_template_id, pod_id, count, last_seen)
+SELECT src_template_id, dst_template_id, pod_id, count, last_seen
+FROM template_transitions;
+
+DROP TABLE template_transitions;
+ALTER TABLE template_transitions_new RENAME TO template_transitions;
@@ -0,0 +1,9 @@
+-- Templates merged into another one
+CREATE TABLE IF NOT EXISTS template_lineage (
+	old_template_id TEXT PRIMARY KEY,
+	new_template_id TEXT NOT NULL,
+	old_template_text TEXT NOT NULL,
+	merged_at TEXT DEFAULT CURRENT_TIMESTAMP,
+
+	FOREIGN KEY (new_template_id) REFERENCES templates(uuid)
+);
@@ -0,0 +1,14 @@
+-- Workload scope of templates, empty for the global scope
+ALTER TABLE templates ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+
+-- Cross-scope view of templates with the same text
+DROP VIEW IF EXISTS template_totals;
+CREATE VIEW template_totals AS
+	SELECT
+		t.template_text,
+		COUNT(DISTINCT t.scope) AS scope_count,
+		COALESCE(SUM(s.total_count), 0) AS total_count,
+		MAX(s.last_seen) AS last_seen
+	FROM templates t
+	LEFT JOIN template_stats s ON s.template_id = t.uuid
+	GROUP BY t.template_text;
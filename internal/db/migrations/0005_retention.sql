@@ -0,0 +1,26 @@
+-- Hourly counts older than the lookback window, rolled up per day
+CREATE TABLE template_daily_counts (
+	template_id TEXT NOT NULL,
+	day TEXT NOT NULL,          -- "2025-11-24"
+	count INTEGER NOT NULL DEFAULT 0,
+	hours INTEGER NOT NULL DEFAULT 0, -- hourly rows rolled up
+
+	PRIMARY KEY (template_id, day)
+);
+
+-- Transitions of pods that are gone, folded per namespace and container
+CREATE TABLE template_workload_transitions (
+	src_template_id TEXT NOT NULL,
+	dst_template_id TEXT NOT NULL,
+	namespace TEXT NOT NULL DEFAULT '',
+	container_name TEXT NOT NULL DEFAULT '',
+	count INTEGER NOT NULL DEFAULT 0,
+	last_seen TEXT,
+
+	PRIMARY KEY (src_template_id, dst_template_id, namespace, container_name),
+
+	FOREIGN KEY (src_template_id) REFERENCES templates(uuid),
+	FOREIGN KEY (dst_template_id) REFERENCES templates(uuid)
+);
+
+CREATE INDEX template_transitions_pod ON template_transitions (pod_id, last_seen);
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	common "log-analyzer/internal/common"
+)
+
+const dayTimeFormat = "2006-01-02"
+
+// Retention of the counters kept on disk and DB file maintenance
+type Retention struct {
+	Interval time.Duration // how often to compact
+
+	// Daily aggregates of hourly counts past the lookback window are kept
+	// this long, 0 to keep them forever
+	DailyCounts time.Duration
+
+	// Transitions of pods not seen for this long are folded into the
+	// aggregate of their namespace and container, and their streams are
+	// forgotten
+	GonePods time.Duration
+
+	Checkpoint time.Duration // how often to checkpoint the WAL, 0 to disable
+	Vacuum     time.Duration // how often to VACUUM the DB file, 0 to disable
+
+	// Counters are aged by the event time of this clock, as they're counted
+	// at event time. A replayed backlog stays within the lookback window of
+	// the detectors instead of being rolled up as it's written. Wall-clock
+	// time if nil
+	Clock *common.EventClock
+}
+
+type CompactStats struct {
+	HoursRolledUp     int64 // hourly rows rolled up into daily aggregates
+	DaysDropped       int64 // daily aggregates past retention
+	TransitionsFolded int64 // transitions of gone pods folded into workload aggregates
+	PodsCollected     int64 // pods whose transitions were folded
+}
+
+// Roll hourly counts past the lookback window at now up into daily
+// aggregates, drop expired daily aggregates and fold transitions of gone
+// pods into per-workload aggregates, in one transaction. Then forget the
+// last templates of the streams of gone pods
+func (tdb *TemplateDB) Compact(now time.Time, r Retention) (CompactStats, error) {
+	var st CompactStats
+
+	// Counting waits for the compaction and the pending counters are
+	// written in the same transaction, so that none are added to hours
+	// already rolled up
+	tdb.flushMu.Lock()
+	defer tdb.flushMu.Unlock()
+	tdb.mu.Lock()
+	defer tdb.mu.Unlock()
+
+	p := tdb.takePendingLocked()
+	committed := false
+	defer func() {
+		if !committed {
+			tdb.cache.dirty.restore(p)
+		}
+		tdb.cache.flushing = false
+	}()
+
+	tx, err := tdb.db.Begin()
+	if err != nil {
+		return st, err
+	}
+	defer tx.Rollback()
+
+	if err := writePending(tx, p); err != nil {
+		return st, fmt.Errorf("failed to write pending counters: %s", err)
+	}
+
+	// Same bound as the hourly windows read by the detectors
+	cutoff := now.UTC().Add(-time.Hour * metricsLookbackHours).Format(hourTimeFormat)
+	if st.HoursRolledUp, err = rollUpHours(tx, cutoff); err != nil {
+		return st, fmt.Errorf("failed to roll up hourly counts: %s", err)
+	}
+
+	if r.DailyCounts > 0 {
+		day := now.UTC().Add(-r.DailyCounts).Format(dayTimeFormat)
+		res, err := tx.Exec(`DELETE FROM template_daily_counts WHERE day < ?;`, day)
+		if err != nil {
+			return st, fmt.Errorf("failed to drop daily counts: %s", err)
+		}
+		st.DaysDropped, _ = res.RowsAffected()
+	}
+
+	if r.GonePods > 0 {
+		lastSeen := now.UTC().Add(-r.GonePods).Format(TimestampFormat)
+		if st.PodsCollected, st.TransitionsFolded, err = foldGonePods(tx, lastSeen); err != nil {
+			return st, fmt.Errorf("failed to fold transitions of gone pods: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return st, err
+	}
+	committed = true
+
+	if r.GonePods > 0 {
+		tdb.prevTidsMu.Lock()
+		tdb.prevTids.expire(now.Add(-r.GonePods))
+		tdb.prevTidsMu.Unlock()
+	}
+	return st, nil
+}
+
+func rollUpHours(tx *sql.Tx, cutoff string) (int64, error) {
+	_, err := tx.Exec(`
+		INSERT INTO template_daily_counts (template_id, day, count, hours)
+		SELECT template_id, substr(hour, 1, 10), SUM(count), COUNT(*)
+		FROM template_hourly_counts
+		WHERE hour <= ?
+		GROUP BY template_id, substr(hour, 1, 10)
+		ON CONFLICT (template_id, day) DO UPDATE SET
+			count = count + excluded.count,
+			hours = hours + excluded.hours;
+	`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM template_hourly_counts WHERE hour <= ?;`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Fold the transitions of pods last seen before lastSeen.
+// Returns the number of pods and transitions folded
+func foldGonePods(tx *sql.Tx, lastSeen string) (int64, int64, error) {
+	_, err := tx.Exec(`
+		CREATE TEMP TABLE IF NOT EXISTS gone_pods (pod_id TEXT PRIMARY KEY);
+		DELETE FROM gone_pods;
+	`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO gone_pods (pod_id)
+		SELECT pod_id
+		FROM template_transitions
+		GROUP BY pod_id
+		HAVING MAX(last_seen) < ?;
+	`, lastSeen)
+	if err != nil {
+		return 0, 0, err
+	}
+	pods, _ := res.RowsAffected()
+	if pods == 0 {
+		return 0, 0, nil
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO template_workload_transitions
+			(src_template_id, dst_template_id, namespace, container_name, count, last_seen)
+		SELECT src_template_id, dst_template_id, namespace, container_name, SUM(count), MAX(last_seen)
+		FROM template_transitions
+		WHERE pod_id IN (SELECT pod_id FROM gone_pods)
+		GROUP BY src_template_id, dst_template_id, namespace, container_name
+		ON CONFLICT (src_template_id, dst_template_id, namespace, container_name) DO UPDATE SET
+			count = count + excluded.count,
+			last_seen = MAX(last_seen, excluded.last_seen);
+	`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err = tx.Exec(`DELETE FROM template_transitions WHERE pod_id IN (SELECT pod_id FROM gone_pods);`)
+	if err != nil {
+		return 0, 0, err
+	}
+	transitions, _ := res.RowsAffected()
+	return pods, transitions, nil
+}
+
+// Rebuild the DB file to release the space of deleted rows
+func (tdb *TemplateDB) Vacuum() error {
+	_, err := tdb.db.Exec("VACUUM")
+	return err
+}
+
+// Periodically compact, checkpoint and vacuum the DB until done is closed
+func (tdb *TemplateDB) StartMaintenance(r Retention, done <-chan bool) {
+	go func() {
+		// A nil channel disables its case
+		var compact, checkpoint, vacuum <-chan time.Time
+		if r.Interval > 0 {
+			t := time.NewTicker(r.Interval)
+			defer t.Stop()
+			compact = t.C
+		}
+		if r.Checkpoint > 0 {
+			t := time.NewTicker(r.Checkpoint)
+			defer t.Stop()
+			checkpoint = t.C
+		}
+		if r.Vacuum > 0 {
+			t := time.NewTicker(r.Vacuum)
+			defer t.Stop()
+			vacuum = t.C
+		}
+
+		for {
+			select {
+			case now := <-compact:
+				if r.Clock != nil {
+					// Nothing to age before the first event
+					if now = r.Clock.Now(); now.IsZero() {
+						continue
+					}
+				}
+				st, err := tdb.Compact(now, r)
+				if err != nil {
+					slog.Error(fmt.Sprintf("Failed to compact template DB: %s", err))
+					continue
+				}
+				if st == (CompactStats{}) {
+					continue
+				}
+				slog.Info(fmt.Sprintf(
+					"Compacted template DB: %d hourly counts rolled up, %d daily counts dropped, %d transitions of %d gone pods folded",
+					st.HoursRolledUp, st.DaysDropped, st.TransitionsFolded, st.PodsCollected,
+				))
+			case <-checkpoint:
+				if err := tdb.Checkpoint(); err != nil {
+					slog.Error(fmt.Sprintf("Failed to checkpoint template DB: %s", err))
+				}
+			case <-vacuum:
+				if err := tdb.Vacuum(); err != nil {
+					slog.Error(fmt.Sprintf("Failed to vacuum template DB: %s", err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
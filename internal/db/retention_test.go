@@ -0,0 +1,215 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	common "log-analyzer/internal/common"
+)
+
+func newTestDB(t *testing.T, seed string) *TemplateDB {
+	t.Helper()
+	tdb, err := NewTemplateDB(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tdb.Close() })
+
+	if _, err := tdb.db.Exec(`
+		INSERT INTO templates (uuid, token_count, template_text) VALUES ('a', 1, 'a'), ('b', 1, 'b');
+	` + seed); err != nil {
+		t.Fatal(err)
+	}
+	return tdb
+}
+
+// Rows of a query of two columns, as "first=second"
+func pairs(t *testing.T, tdb *TemplateDB, query string) []string {
+	t.Helper()
+	rows, err := tdb.db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, k+"="+v)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompact(t *testing.T) {
+	tdb := newTestDB(t, `
+		INSERT INTO template_hourly_counts (template_id, hour, count) VALUES
+			('a', '2025-11-16 05', 4),
+			('a', '2025-11-17 12', 2),
+			('a', '2025-11-17 13', 3),
+			('a', '2025-11-17 14', 1),
+			('a', '2025-11-24 13', 7);
+		INSERT INTO template_daily_counts (template_id, day, count, hours) VALUES
+			('a', '2025-10-01', 1, 1),
+			('a', '2025-10-20', 1, 1),
+			('a', '2025-10-25', 1, 1),
+			('a', '2025-11-17', 10, 5);
+		INSERT INTO template_transitions (src_template_id, dst_template_id, pod_id, container_name, namespace, count, last_seen) VALUES
+			('a', 'b', 'pod-1', 'api', 'shop', 3, '2025-11-10 00:00:00'),
+			('b', 'a', 'pod-1', 'api', 'shop', 2, '2025-11-12 00:00:00'),
+			('a', 'b', 'pod-2', 'api', 'shop', 5, '2025-11-10 00:00:00'),
+			('b', 'a', 'pod-2', 'api', 'shop', 1, '2025-11-20 00:00:00'),
+			('a', 'b', 'pod-3', 'api', 'shop', 4, '2025-11-01 00:00:00');
+	`)
+
+	now := time.Date(2025, 11, 24, 13, 30, 0, 0, time.UTC)
+	st, err := tdb.Compact(now, Retention{DailyCounts: 30 * 24 * time.Hour, GonePods: 7 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hours up to 2025-11-17 13, a lookback window before now, are rolled
+	// up. Days before 2025-10-25 are dropped. Pods 1 and 3 were last seen
+	// before 2025-11-17 13:30
+	want := CompactStats{HoursRolledUp: 3, DaysDropped: 2, TransitionsFolded: 3, PodsCollected: 2}
+	if st != want {
+		t.Fatalf("got %+v, want %+v", st, want)
+	}
+
+	checks := []struct {
+		query string
+		want  []string
+	}{
+		{
+			`SELECT hour, count FROM template_hourly_counts ORDER BY hour;`,
+			[]string{"2025-11-17 14=1", "2025-11-24 13=7"},
+		},
+		{
+			`SELECT day, count || '/' || hours FROM template_daily_counts ORDER BY day;`,
+			[]string{"2025-10-25=1/1", "2025-11-16=4/1", "2025-11-17=15/7"},
+		},
+		{
+			`SELECT src_template_id || dst_template_id || '/' || namespace || '/' || container_name, count || ' ' || last_seen
+			FROM template_workload_transitions ORDER BY 1;`,
+			[]string{"ab/shop/api=7 2025-11-10 00:00:00", "ba/shop/api=2 2025-11-12 00:00:00"},
+		},
+		{
+			`SELECT pod_id || ' ' || src_template_id || dst_template_id, count FROM template_transitions ORDER BY 1;`,
+			[]string{"pod-2 ab=5", "pod-2 ba=1"},
+		},
+	}
+	for _, c := range checks {
+		if got := pairs(t, tdb, c.query); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s\ngot  %v\nwant %v", c.query, got, c.want)
+		}
+	}
+
+	// Nothing left to compact
+	if st, err = tdb.Compact(now, Retention{DailyCounts: 30 * 24 * time.Hour, GonePods: 7 * 24 * time.Hour}); err != nil || st != (CompactStats{}) {
+		t.Fatalf("got %+v, %v compacting again, want nothing", st, err)
+	}
+}
+
+func TestMaintenanceEventTime(t *testing.T) {
+	// Hours of a replayed backlog, more than a lookback window before the
+	// wall clock but not before its newest event
+	tdb := newTestDB(t, `
+		INSERT INTO template_hourly_counts (template_id, hour, count) VALUES
+			('a', '2025-11-10 13', 1),
+			('a', '2025-11-20 13', 1);
+	`)
+
+	clock := &common.EventClock{}
+	clock.Resolve(time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC))
+
+	done := make(chan bool)
+	defer close(done)
+	tdb.StartMaintenance(Retention{Interval: 5 * time.Millisecond, Clock: clock}, done)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hours := pairs(t, tdb, `SELECT hour, count FROM template_hourly_counts ORDER BY hour;`)
+		if len(hours) == 1 {
+			if hours[0] != "2025-11-20 13=1" {
+				t.Fatalf("got hourly counts %v, want the hour within the lookback window of the events", hours)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got hourly counts %v, want the hour past the lookback window of the events rolled up", hours)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestExpireStreams(t *testing.T) {
+	t0 := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+	gone := common.K8sMetadata{PodID: "pod-1", Namespace: "shop", ContainerName: "api"}
+	alive := common.K8sMetadata{PodID: "pod-2", Namespace: "shop", ContainerName: "api"}
+
+	t.Run("sqlite", func(t *testing.T) {
+		tdb := newTestDB(t, "")
+		transitions(t, tdb, gone, t0, "a", "b")
+		transitions(t, tdb, alive, t0.Add(7*24*time.Hour), "a", "b")
+		if len(tdb.prevTids) != 2 {
+			t.Fatalf("got %d streams, want 2", len(tdb.prevTids))
+		}
+
+		flush(t, tdb)
+		st, err := tdb.Compact(t0.Add(8*24*time.Hour), Retention{GonePods: 7 * 24 * time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.PodsCollected != 1 {
+			t.Fatalf("got %d pods collected, want 1", st.PodsCollected)
+		}
+		if _, ok := tdb.prevTids[streamKey(alive)]; !ok || len(tdb.prevTids) != 1 {
+			t.Fatalf("got streams %v, want only the stream of the pod still alive", tdb.prevTids)
+		}
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		ms := NewMemoryStore()
+		defer ms.Close()
+		transitions(t, ms, gone, t0, "a", "b")
+		transitions(t, ms, alive, t0.Add(time.Hour), "a", "b")
+		if len(ms.prevTids) != 2 {
+			t.Fatalf("got %d streams, want 2", len(ms.prevTids))
+		}
+
+		transitions(t, ms, alive, t0.Add(memoryStreamIdleTimeout+time.Hour), "a")
+		if _, ok := ms.prevTids[streamKey(alive)]; !ok || len(ms.prevTids) != 1 {
+			t.Fatalf("got streams %v, want only the stream of the pod still alive", ms.prevTids)
+		}
+	})
+}
+
+func TestCompactPending(t *testing.T) {
+	tdb := newTestDB(t, `
+		INSERT INTO template_hourly_counts (template_id, hour, count) VALUES ('a', '2025-11-17 12', 2);
+	`)
+
+	// Counted but not flushed yet, in an hour to roll up and one to keep
+	old := time.Date(2025, 11, 17, 12, 30, 0, 0, time.UTC)
+	recent := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+	count(t, tdb, "a", old, old, recent)
+
+	if _, err := tdb.Compact(recent, Retention{}); err != nil {
+		t.Fatal(err)
+	}
+	flush(t, tdb)
+
+	if got, want := pairs(t, tdb, `SELECT hour, count FROM template_hourly_counts ORDER BY hour;`), []string{"2025-11-24 13=1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got hourly counts %v, want %v", got, want)
+	}
+	if got, want := pairs(t, tdb, `SELECT day, count || '/' || hours FROM template_daily_counts ORDER BY day;`), []string{"2025-11-17=4/1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got daily counts %v, want %v with the pending counts", got, want)
+	}
+}
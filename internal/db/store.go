@@ -0,0 +1,86 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	common "log-analyzer/internal/common"
+)
+
+// Returned by GetIATStats for a template that has never been counted
+var ErrNotCounted = errors.New("template has not been counted")
+
+// Storage of templates and their counters, shared by the parser and the
+// anomaly detectors. Implementations are safe for concurrent use
+type Store interface {
+	SaveTemplate(t common.Template) error
+	UpdateTemplate(t common.Template) error
+	MergeTemplates(survivor common.Template, merged []string) error
+	GetAllTemplates() (map[int][]common.Template, error)
+
+	CountTemplate(uuid string, ts time.Time) error
+	CountTemplateHourly(uuid string, ts time.Time) error
+	CountTransition(uuid string, meta common.K8sMetadata, ts time.Time) error
+	InsertHourlyRow(uuid string, ts time.Time) error
+
+	GetIATStats(uuid string) (count int, mean float64, stddev float64, lastTs string, err error)
+	GetHourlyStats(tid string, ts time.Time) (mean float64, stddev float64, err error)
+	GetHourlyCount(tid string, ts time.Time) (int, error)
+	GetTransitionCounts(tid string, meta common.K8sMetadata) (totalCount int, transitionCount int, err error)
+	GetAllTemplateStats() ([]TemplateStats, error)
+
+	GetTemplateCounts() ([]TemplateCount, error)
+	GetCrossScopeCounts() ([]CrossScopeCount, error)
+
+	Close() error
+}
+
+// Implemented by stores that write their counters back to disk
+type Persister interface {
+	StartFlush(interval time.Duration, done <-chan bool)
+	StartMaintenance(r Retention, done <-chan bool)
+	Flush() error
+	Checkpoint() error
+}
+
+// Mean and sample stddev of the hourly counts of the lookback window before
+// event time ts, up to and including the hour of ts. Hours after it are left
+// out, a late event is compared with the baseline it arrived in
+func hourlyStats(counts map[string]int, ts time.Time) (mean float64, stddev float64) {
+	cutoff := ts.UTC().Add(-time.Hour * metricsLookbackHours).Format(hourTimeFormat)
+	until := ts.UTC().Format(hourTimeFormat)
+
+	var n, sum, sumSq float64
+	for hour, count := range counts {
+		if hour > cutoff && hour <= until {
+			n++
+			sum += float64(count)
+			sumSq += float64(count) * float64(count)
+		}
+	}
+
+	if n > 0 {
+		mean = sum / n
+	}
+	if n > 1 {
+		stddev = math.Sqrt((n*sumSq - sum*sum) / ((n - 1) * n))
+	}
+	return
+}
+
+// Pool the IAT mean and stddev of two populations of n1 and n2 arrivals
+func poolIAT(n1, mean1, stddev1, n2, mean2, stddev2 float64) (mean float64, stddev float64) {
+	mean, stddev = mean1, stddev1
+	if n1+n2 > 0 {
+		mean = (n1*mean1 + n2*mean2) / (n1 + n2)
+	}
+	if n1+n2 > 1 {
+		delta := mean2 - mean1
+		m2 := stddev1*stddev1*math.Max(n1-1, 0) +
+			stddev2*stddev2*math.Max(n2-1, 0) +
+			delta*delta*n1*n2/(n1+n2)
+		stddev = math.Sqrt(m2 / (n1 + n2 - 1))
+	}
+	return
+}
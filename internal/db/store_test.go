@@ -0,0 +1,347 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common "log-analyzer/internal/common"
+)
+
+// Every Store runs through the same cases
+var stores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"sqlite", func(t *testing.T) Store {
+		tdb, err := NewTemplateDB(filepath.Join(t.TempDir(), "data.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tdb
+	}},
+	{"memory", func(t *testing.T) Store {
+		return NewMemoryStore()
+	}},
+}
+
+// Write the counters of stores that persist them, so the reads that follow
+// load them back from disk
+func flush(t *testing.T, s Store) {
+	t.Helper()
+	if p, ok := s.(Persister); ok {
+		if err := p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func template(id, scope, text string) common.Template {
+	return common.Template{ID: id, Scope: scope, Tokens: strings.Fields(text)}
+}
+
+func saveTemplates(t *testing.T, s Store, templates ...common.Template) {
+	t.Helper()
+	for _, tmpl := range templates {
+		if err := s.SaveTemplate(tmpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func count(t *testing.T, s Store, uuid string, ts ...time.Time) {
+	t.Helper()
+	for _, ts := range ts {
+		if err := s.CountTemplate(uuid, ts); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CountTemplateHourly(uuid, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func transitions(t *testing.T, s Store, meta common.K8sMetadata, ts time.Time, uuids ...string) {
+	t.Helper()
+	for _, uuid := range uuids {
+		if err := s.CountTransition(uuid, meta, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// IAT stats of arrivals at times, as counted one by one
+func replayIAT(times ...time.Time) (count int, mean float64, stddev float64, lastTs string) {
+	for _, ts := range times {
+		newMean, newStddev, inOrder, _ := calculateIAT(lastTs, mean, stddev, count, ts)
+		count++
+		if inOrder {
+			mean, stddev, lastTs = newMean, newStddev, ts.UTC().Format(TimestampFormat)
+		}
+	}
+	return
+}
+
+func assertIAT(t *testing.T, s Store, uuid string, count int, mean, stddev float64, lastTs string) {
+	t.Helper()
+	gotCount, gotMean, gotStddev, gotLastTs, err := s.GetIATStats(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotCount != count || math.Abs(gotMean-mean) > 1e-9 || math.Abs(gotStddev-stddev) > 1e-9 || gotLastTs != lastTs {
+		t.Fatalf("got IAT stats %d %g %g %q, want %d %g %g %q",
+			gotCount, gotMean, gotStddev, gotLastTs, count, mean, stddev, lastTs)
+	}
+}
+
+func TestStore(t *testing.T) {
+	t0 := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+	pod := common.K8sMetadata{PodID: "pod-1", PodName: "api-1", Namespace: "shop", ContainerName: "api"}
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"templates", func(t *testing.T, s Store) {
+			saveTemplates(t, s,
+				template("a", "shop/api", "a b"),
+				template("b", "", "c d e"),
+				template("c", "shop/api", "f g"),
+			)
+			if err := s.UpdateTemplate(template("a", "shop/api", "a *")); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.GetAllTemplates()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[int][]common.Template{
+				2: {template("a", "shop/api", "a *"), template("c", "shop/api", "f g")},
+				3: {template("b", "", "c d e")},
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("got templates %v, want %v oldest first", got, want)
+			}
+		}},
+
+		{"iat stats", func(t *testing.T, s Store) {
+			times := []time.Time{t0, t0.Add(10 * time.Second), t0.Add(30 * time.Second), t0.Add(70 * time.Second)}
+			saveTemplates(t, s, template("a", "", "a"))
+			count(t, s, "a", times[:2]...)
+			flush(t, s)
+			count(t, s, "a", times[2:]...)
+
+			n, mean, stddev, lastTs := replayIAT(times...)
+			assertIAT(t, s, "a", n, mean, stddev, lastTs)
+
+			// A late arrival is counted without changing the IATs
+			count(t, s, "a", t0.Add(5*time.Second))
+			assertIAT(t, s, "a", n+1, mean, stddev, lastTs)
+
+			flush(t, s)
+			stats, err := s.GetAllTemplateStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != 1 || stats[0].TemplateID != "a" || stats[0].TotalCount != n+1 || !stats[0].LastSeen.Equal(times[3]) {
+				t.Fatalf("got template stats %+v, want a counted %d times last seen at %s", stats, n+1, times[3])
+			}
+		}},
+
+		{"not counted", func(t *testing.T, s Store) {
+			saveTemplates(t, s, template("a", "", "a"))
+			if _, _, _, _, err := s.GetIATStats("a"); !errors.Is(err, ErrNotCounted) {
+				t.Fatalf("got error %v, want ErrNotCounted", err)
+			}
+		}},
+
+		{"hourly", func(t *testing.T, s Store) {
+			saveTemplates(t, s, template("a", "", "a"))
+			h := func(hours int) time.Time { return t0.Add(time.Duration(hours) * time.Hour) }
+
+			// Counts 1, 3 and 4, and an hour out of the lookback window
+			count(t, s, "a", h(-metricsLookbackHours-1))
+			count(t, s, "a", h(0))
+			flush(t, s)
+			count(t, s, "a", h(1), h(1), h(1))
+			if err := s.InsertHourlyRow("a", h(2)); err != nil {
+				t.Fatal(err)
+			}
+			flush(t, s)
+			count(t, s, "a", h(2), h(2), h(2), h(2))
+
+			for hours, want := range map[int]int{0: 1, 1: 3, 2: 4, 3: 0} {
+				got, err := s.GetHourlyCount("a", h(hours))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("hour %d: got count %d, want %d", hours, got, want)
+				}
+			}
+
+			mean, stddev, err := s.GetHourlyStats("a", h(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantMean, wantStddev := 8.0/3, math.Sqrt(7.0/3)
+			if math.Abs(mean-wantMean) > 1e-9 || math.Abs(stddev-wantStddev) > 1e-9 {
+				t.Fatalf("got hourly mean %g stddev %g, want %g and %g", mean, stddev, wantMean, wantStddev)
+			}
+		}},
+
+		{"hourly late", func(t *testing.T, s Store) {
+			saveTemplates(t, s, template("a", "", "a"))
+			h := func(hours int) time.Time { return t0.Add(time.Duration(hours) * time.Hour) }
+
+			// A window of counts 1, 3 and 5 seeded ahead of a burst in a
+			// later hour
+			count(t, s, "a", h(0), h(1), h(1), h(1))
+			for range 20 {
+				count(t, s, "a", h(5))
+			}
+			flush(t, s)
+			count(t, s, "a", h(2), h(2), h(2), h(2), h(2))
+
+			// A late event in hour 2 looks back on the hours up to its own
+			mean, stddev, err := s.GetHourlyStats("a", h(2).Add(30*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mean != 3 || stddev != 2 {
+				t.Fatalf("got hourly mean %g stddev %g, want 3 and 2 without the later hour", mean, stddev)
+			}
+		}},
+
+		{"transitions", func(t *testing.T, s Store) {
+			saveTemplates(t, s, template("a", "", "a"), template("b", "", "b"))
+			other := pod
+			other.PodID = "pod-2"
+
+			transitions(t, s, pod, t0, "a", "b", "a")
+			flush(t, s)
+			transitions(t, s, pod, t0, "b")
+			transitions(t, s, other, t0, "b")
+
+			// a → b twice, b → a once, the other pod only has b
+			total, n, err := s.GetTransitionCounts("b", pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 2 || n != 0 {
+				t.Fatalf("got %d transitions into b, %d from b, want 2 and 0", total, n)
+			}
+			transitions(t, s, pod, t0, "a")
+			if total, n, _ = s.GetTransitionCounts("b", pod); total != 2 || n != 2 {
+				t.Fatalf("got %d transitions into b, %d from a, want 2 and 2", total, n)
+			}
+			if total, n, _ = s.GetTransitionCounts("a", other); total != 0 || n != 0 {
+				t.Fatalf("got %d transitions into a in the other pod, %d from b, want none", total, n)
+			}
+		}},
+
+		{"merge", func(t *testing.T, s Store) {
+			saveTemplates(t, s, template("a", "", "a b"), template("b", "", "a c"))
+			count(t, s, "a", t0, t0.Add(10*time.Second))
+			count(t, s, "b", t0.Add(time.Hour), t0.Add(time.Hour+30*time.Second), t0.Add(time.Hour+40*time.Second))
+			transitions(t, s, pod, t0, "a", "b", "a", "b")
+			flush(t, s)
+			transitions(t, s, pod, t0, "a")
+
+			n1, mean1, stddev1, _, _ := s.GetIATStats("a")
+			n2, mean2, stddev2, lastTs, _ := s.GetIATStats("b")
+			mean, stddev := poolIAT(float64(n1), mean1, stddev1, float64(n2), mean2, stddev2)
+
+			if err := s.MergeTemplates(template("a", "", "a *"), []string{"a", "b"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.GetAllTemplates()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[int][]common.Template{2: {template("a", "", "a *")}}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("got templates %v, want %v", got, want)
+			}
+
+			assertIAT(t, s, "a", n1+n2, mean, stddev, lastTs)
+			if _, _, _, _, err := s.GetIATStats("b"); !errors.Is(err, ErrNotCounted) {
+				t.Fatalf("got error %v of the merged template, want ErrNotCounted", err)
+			}
+
+			for ts, want := range map[time.Time]int{t0: 2, t0.Add(time.Hour): 3} {
+				if got, _ := s.GetHourlyCount("a", ts); got != want {
+					t.Errorf("hour %s: got count %d, want %d", ts, got, want)
+				}
+				if got, _ := s.GetHourlyCount("b", ts); got != 0 {
+					t.Errorf("hour %s: got count %d of the merged template, want 0", ts, got)
+				}
+			}
+
+			// Every transition between a and b is now a → a
+			if total, n, _ := s.GetTransitionCounts("a", pod); total != 4 || n != 4 {
+				t.Fatalf("got %d transitions into a, %d from a, want 4 and 4", total, n)
+			}
+		}},
+
+		{"counts", func(t *testing.T, s Store) {
+			saveTemplates(t, s,
+				template("a", "shop/api", "x y"),
+				template("b", "shop/web", "x y"),
+				template("c", "", "z"),
+				template("d", "", "w"),
+				template("e", "shop/api", "v"),
+			)
+			count(t, s, "a", t0, t0.Add(time.Second))
+			flush(t, s)
+			count(t, s, "a", t0.Add(2*time.Second))
+			count(t, s, "b", t0)
+			count(t, s, "c", t0, t0.Add(time.Second))
+			count(t, s, "e", t0)
+
+			counts, err := s.GetTemplateCounts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCounts := []TemplateCount{
+				{TemplateID: "a", Scope: "shop/api", Text: "x y", TotalCount: 3},
+				{TemplateID: "c", Text: "z", TotalCount: 2},
+				{TemplateID: "e", Scope: "shop/api", Text: "v", TotalCount: 1},
+				{TemplateID: "b", Scope: "shop/web", Text: "x y", TotalCount: 1},
+				{TemplateID: "d", Text: "w"},
+			}
+			if fmt.Sprint(counts) != fmt.Sprint(wantCounts) {
+				t.Fatalf("got template counts %+v, want %+v", counts, wantCounts)
+			}
+
+			cross, err := s.GetCrossScopeCounts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCross := []CrossScopeCount{
+				{Text: "x y", ScopeCount: 2, TotalCount: 4},
+				{Text: "z", ScopeCount: 1, TotalCount: 2},
+				{Text: "v", ScopeCount: 1, TotalCount: 1},
+				{Text: "w", ScopeCount: 1},
+			}
+			if fmt.Sprint(cross) != fmt.Sprint(wantCross) {
+				t.Fatalf("got cross-scope counts %+v, want %+v", cross, wantCross)
+			}
+		}},
+	}
+
+	for _, st := range stores {
+		for _, tt := range tests {
+			t.Run(st.name+"/"+tt.name, func(t *testing.T) {
+				s := st.open(t)
+				defer s.Close()
+				tt.run(t, s)
+			})
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Package elastic reads Elasticsearch bulk API requests, as sent by
+// Filebeat, Vector, Logstash and Fluent Bit's es output, into log events.
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log-analyzer/internal/common"
+	"log-analyzer/internal/ingest"
+	"log-analyzer/internal/parser"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Version reported to clients probing the cluster before they ship
+const Version = "8.11.0"
+
+// Bulk actions
+const (
+	actionIndex  = "index"
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+// Error of a request that isn't a valid bulk request, the whole request is
+// rejected
+type RequestError struct {
+	Line   int
+	Reason string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+// Response of the bulk API
+type BulkResponse struct {
+	Took   int64                  `json:"took"`
+	Errors bool                   `json:"errors"`
+	Items  []map[string]*BulkItem `json:"items"` // action to outcome
+}
+
+type BulkItem struct {
+	Index       string     `json:"_index"`
+	ID          string     `json:"_id"`
+	Version     int        `json:"_version,omitempty"`
+	Result      string     `json:"result,omitempty"`
+	Shards      *Shards    `json:"_shards,omitempty"`
+	SeqNo       *int       `json:"_seq_no,omitempty"`
+	PrimaryTerm int        `json:"_primary_term,omitempty"`
+	Status      int        `json:"status"`
+	Error       *ItemError `json:"error,omitempty"`
+}
+
+type Shards struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Failed     int `json:"failed"`
+}
+
+type ItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type actionMeta struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+// Read the action and document line pairs of a bulk request and feed the
+// documents of index, create and update actions to process. Documents that
+// don't decode, or have no log line, fail their item with a status clients
+// don't retry. Returns a *RequestError if an action line is invalid
+func ReadBulk(r io.Reader, defaultIndex string, process func(common.LogEvent)) (*BulkResponse, error) {
+	start := time.Now()
+	resp := &BulkResponse{Items: []map[string]*BulkItem{}}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), ingest.MaxLineSize)
+	line := 0
+	next := func() ([]byte, bool) {
+		for scanner.Scan() {
+			line++
+			if b := bytes.TrimSpace(scanner.Bytes()); len(b) > 0 {
+				return b, true
+			}
+		}
+		return nil, false
+	}
+
+	for {
+		b, ok := next()
+		if !ok {
+			break
+		}
+
+		var action map[string]actionMeta
+		if err := json.Unmarshal(b, &action); err != nil || len(action) != 1 {
+			return nil, &RequestError{Line: line, Reason: "malformed action/metadata line, expected a single action"}
+		}
+		var name string
+		var meta actionMeta
+		for name, meta = range action {
+		}
+		if meta.Index == "" {
+			meta.Index = defaultIndex
+		}
+		if meta.ID == "" {
+			meta.ID = uuid.NewString()
+		}
+		item := &BulkItem{Index: meta.Index, ID: meta.ID}
+		resp.Items = append(resp.Items, map[string]*BulkItem{name: item})
+
+		switch name {
+		case actionIndex, actionCreate, actionUpdate:
+		case actionDelete:
+			// Nothing is stored, so there is nothing to delete
+			item.Result, item.Status = "not_found", 404
+			continue
+		default:
+			return nil, &RequestError{Line: line, Reason: fmt.Sprintf("unknown action [%s]", name)}
+		}
+
+		b, ok = next()
+		if !ok {
+			return nil, &RequestError{Line: line, Reason: "the bulk request must be terminated by a newline"}
+		}
+		le, err := documentEvent(b, name == actionUpdate)
+		if err != nil {
+			item.Status = 400
+			item.Error = &ItemError{Type: "document_parsing_exception", Reason: err.Error()}
+			resp.Errors = true
+			continue
+		}
+		process(le)
+
+		seqNo := len(resp.Items) - 1
+		item.Version = 1
+		item.Result, item.Status = "created", 201
+		if name == actionUpdate {
+			item.Result, item.Status = "updated", 200
+		}
+		item.Shards = &Shards{Total: 1, Successful: 1}
+		item.SeqNo = &seqNo
+		item.PrimaryTerm = 1
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	resp.Took = time.Since(start).Milliseconds()
+	return resp, nil
+}
+
+// Map a document onto a log event. The document of an update action is
+// wrapped in a doc field
+func documentEvent(b []byte, update bool) (common.LogEvent, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return common.LogEvent{}, fmt.Errorf("failed to parse document: %s", err)
+	}
+	if update {
+		inner, ok := doc["doc"].(map[string]interface{})
+		if !ok {
+			return common.LogEvent{}, errors.New("update without a doc")
+		}
+		doc = inner
+	}
+
+	msg, ok := parser.LogMessage(doc)
+	if !ok {
+		return common.LogEvent{}, errors.New("document has no message field")
+	}
+	le := common.LogEvent{
+		Log:         msg,
+		Time:        timestamp(doc),
+		Stream:      str(doc, "stream"),
+		Level:       first(str(doc, "log.level"), str(doc, "log", "level"), str(doc, "level")),
+		TraceID:     first(str(doc, "trace.id"), str(doc, "trace", "id"), str(doc, "trace_id")),
+		SpanID:      first(str(doc, "span.id"), str(doc, "span", "id"), str(doc, "span_id")),
+		K8sMetadata: k8sMetadata(doc),
+	}
+	return le, nil
+}
+
+// Kubernetes metadata as written by Fluent Bit, Filebeat (ECS) or Vector
+func k8sMetadata(doc map[string]interface{}) common.K8sMetadata {
+	k, _ := doc["kubernetes"].(map[string]interface{})
+	meta := common.K8sMetadata{
+		PodName:       first(str(k, "pod_name"), str(k, "pod", "name")),
+		PodID:         first(str(k, "pod_id"), str(k, "pod", "uid"), str(k, "pod_uid")),
+		Namespace:     first(str(k, "namespace_name"), str(k, "namespace"), str(k, "pod_namespace")),
+		ContainerName: first(str(k, "container_name"), str(k, "container", "name")),
+		ContainerImg:  first(str(k, "container_image"), str(k, "container", "image"), str(doc, "container", "image", "name")),
+		Host:          first(str(k, "host"), str(k, "node", "name"), str(k, "pod_node_name"), str(doc, "host", "name"), str(doc, "host", "hostname")),
+	}
+	meta.Labels, _ = k["labels"].(map[string]interface{})
+	if meta.Labels == nil {
+		meta.Labels, _ = k["pod_labels"].(map[string]interface{})
+	}
+	meta.Annotations, _ = k["annotations"].(map[string]interface{})
+
+	// Logs of plain containers and hosts
+	if meta.ContainerName == "" {
+		meta.ContainerName = first(str(doc, "container", "name"), str(doc, "service", "name"))
+	}
+	if meta.PodName == "" {
+		meta.PodName = meta.Host
+	}
+	if meta.PodID == "" {
+		meta.PodID = meta.PodName
+	}
+	return meta
+}
+
+// Event time of @timestamp, an RFC 3339 date or epoch milliseconds
+func timestamp(doc map[string]interface{}) time.Time {
+	for _, key := range []string{"@timestamp", "timestamp", "time"} {
+		switch v := doc[key].(type) {
+		case string:
+			if ts, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return ts.UTC()
+			}
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.UnixMilli(ms).UTC()
+			}
+		case float64:
+			return time.UnixMilli(int64(v)).UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// String at a path of nested objects
+func str(m map[string]interface{}, path ...string) string {
+	for i, key := range path {
+		if i == len(path)-1 {
+			s, _ := m[key].(string)
+			return s
+		}
+		m, _ = m[key].(map[string]interface{})
+	}
+	return ""
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
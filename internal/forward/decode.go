@@ -0,0 +1,308 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log-analyzer/internal/common"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+const (
+	eventTimeExt = 0 // msgpack extension type of EventTime
+)
+
+var errMessageTooLarge = errors.New("forward message exceeds the size limit")
+
+// Options sent along with a Forward message
+type options struct {
+	Chunk      string `msgpack:"chunk"`      // ack the message with this id
+	Compressed string `msgpack:"compressed"` // gzip for CompressedPackedForward
+	Size       int    `msgpack:"size"`
+}
+
+// A decoded Forward message
+type message struct {
+	Tag     string
+	Events  []common.LogEvent
+	Options options
+	Invalid int // records that didn't decode as a log event
+}
+
+// Decodes the messages read from a connection. A message fails once more than
+// maxBytes of it are read, whatever its mode, or once its entries decompress
+// to more than maxBytes. No limit if maxBytes is 0
+type messageDecoder struct {
+	r        *messageReader
+	dec      *msgpack.Decoder
+	maxBytes int64
+}
+
+func newMessageDecoder(r io.Reader, maxBytes int64) *messageDecoder {
+	mr := &messageReader{r: bufio.NewReader(r), max: maxBytes}
+	return &messageDecoder{r: mr, dec: msgpack.NewDecoder(mr), maxBytes: maxBytes}
+}
+
+func (md *messageDecoder) next() (message, error) {
+	md.r.n = md.r.max
+	return decodeMessage(md.dec, md.maxBytes)
+}
+
+// Decode the next message of any Forward mode:
+//
+//	Message:                 [tag, time, record, option?]
+//	Forward:                 [tag, [[time, record], ...], option?]
+//	PackedForward:           [tag, <concatenated [time, record]>, option?]
+//	CompressedPackedForward: PackedForward with option compressed=gzip
+func decodeMessage(dec *msgpack.Decoder, maxBytes int64) (message, error) {
+	var msg message
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return msg, err
+	}
+	if n < 2 || n > 4 {
+		return msg, fmt.Errorf("invalid forward message with %d elements", n)
+	}
+	if msg.Tag, err = dec.DecodeString(); err != nil {
+		return msg, err
+	}
+
+	c, err := dec.PeekCode()
+	if err != nil {
+		return msg, err
+	}
+	var packed []byte
+	rest := n - 2
+	switch {
+	case msgpcode.IsFixedArray(c) || c == msgpcode.Array16 || c == msgpcode.Array32:
+		entries, err := dec.DecodeArrayLen()
+		if err != nil {
+			return msg, err
+		}
+		for range entries {
+			if err := msg.decodeEntry(dec); err != nil {
+				return msg, err
+			}
+		}
+	case msgpcode.IsString(c) || msgpcode.IsBin(c):
+		if packed, err = dec.DecodeBytes(); err != nil {
+			return msg, err
+		}
+	default:
+		if n < 3 {
+			return msg, fmt.Errorf("invalid forward message without a record")
+		}
+		ts, err := decodeTime(dec)
+		if err != nil {
+			return msg, err
+		}
+		if err := msg.decodeRecord(dec, ts); err != nil {
+			return msg, err
+		}
+		rest--
+	}
+
+	if rest > 0 {
+		if err := dec.Decode(&msg.Options); err != nil {
+			return msg, fmt.Errorf("invalid forward options: %w", err)
+		}
+	}
+
+	if packed != nil {
+		if err := msg.decodePacked(packed, maxBytes); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+func (msg *message) decodePacked(packed []byte, maxBytes int64) error {
+	var r io.Reader = bytes.NewReader(packed)
+	switch msg.Options.Compressed {
+	case "", "text":
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("invalid gzip entries: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+		if maxBytes > 0 {
+			r = &limitedReader{r: zr, n: maxBytes}
+		}
+	default:
+		return fmt.Errorf("unsupported compression %q", msg.Options.Compressed)
+	}
+
+	dec := msgpack.NewDecoder(r)
+	for {
+		if _, err := dec.PeekCode(); err == io.EOF {
+			return nil
+		}
+		if err := msg.decodeEntry(dec); err != nil {
+			return err
+		}
+	}
+}
+
+// Decode a [time, record] entry. Newer Fluent Bit versions send
+// [[time, metadata], record] entries
+func (msg *message) decodeEntry(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n != 2 {
+		return fmt.Errorf("invalid forward entry with %d elements", n)
+	}
+
+	var ts time.Time
+	c, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+	if msgpcode.IsFixedArray(c) {
+		header, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		if header < 1 {
+			return fmt.Errorf("invalid forward entry header")
+		}
+		if ts, err = decodeTime(dec); err != nil {
+			return err
+		}
+		for range header - 1 {
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+		}
+	} else if ts, err = decodeTime(dec); err != nil {
+		return err
+	}
+	return msg.decodeRecord(dec, ts)
+}
+
+// Decode a record into a log event stamped at ts. A record with fields of
+// unexpected types is counted as invalid and skipped
+func (msg *message) decodeRecord(dec *msgpack.Decoder, ts time.Time) error {
+	raw, err := dec.DecodeRaw()
+	if err != nil {
+		return err
+	}
+
+	rd := msgpack.NewDecoder(bytes.NewReader(raw))
+	rd.SetCustomStructTag("json")
+	var le common.LogEvent
+	if err := rd.Decode(&le); err != nil {
+		msg.Invalid++
+		return nil
+	}
+	if le.Date <= 0 && !ts.IsZero() {
+		le.Time = ts
+	}
+	msg.Events = append(msg.Events, le)
+	return nil
+}
+
+// Decode an EventTime extension, or integer or float seconds since the epoch
+func decodeTime(dec *msgpack.Decoder) (time.Time, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch {
+	case msgpcode.IsExt(c):
+		id, n, err := dec.DecodeExtHeader()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if id != eventTimeExt || n != 8 {
+			return time.Time{}, fmt.Errorf("invalid event time extension %d of %d bytes", id, n)
+		}
+		var b [8]byte
+		if err := dec.ReadFull(b[:]); err != nil {
+			return time.Time{}, err
+		}
+		sec := binary.BigEndian.Uint32(b[:4])
+		nsec := binary.BigEndian.Uint32(b[4:])
+		return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+	case c == msgpcode.Float || c == msgpcode.Double:
+		f, err := dec.DecodeFloat64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(f*float64(time.Second))).UTC(), nil
+	default:
+		sec, err := dec.DecodeInt64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0).UTC(), nil
+	}
+}
+
+// Counts down the bytes of the current message as they're read, and fails
+// once they run out. Being an io.ByteScanner, the decoder reads from it
+// directly instead of buffering ahead into the next message
+type messageReader struct {
+	r   *bufio.Reader
+	max int64 // 0 for no limit
+	n   int64 // bytes of the current message left
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	if mr.max > 0 {
+		if mr.n <= 0 {
+			return 0, errMessageTooLarge
+		}
+		if int64(len(p)) > mr.n {
+			p = p[:mr.n]
+		}
+	}
+	n, err := mr.r.Read(p)
+	mr.n -= int64(n)
+	return n, err
+}
+
+func (mr *messageReader) ReadByte() (byte, error) {
+	if mr.max > 0 && mr.n <= 0 {
+		return 0, errMessageTooLarge
+	}
+	b, err := mr.r.ReadByte()
+	if err == nil {
+		mr.n--
+	}
+	return b, err
+}
+
+func (mr *messageReader) UnreadByte() error {
+	err := mr.r.UnreadByte()
+	if err == nil {
+		mr.n++
+	}
+	return err
+}
+
+// Fails once more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, fmt.Errorf("decompressed entries: %w", errMessageTooLarge)
+	}
+	return n, err
+}
@@ -0,0 +1,133 @@
+// Package forward implements a Fluent Forward protocol (v1) listener, so
+// Fluent Bit and Fluentd can ship logs over their forward output.
+// Handshakes with a shared key are not supported.
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log-analyzer/internal/common"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	idleTimeout = 5 * time.Minute
+)
+
+// Listener accepts Forward connections and feeds the records of every
+// message to Process. Messages carrying a chunk option are acknowledged once
+// Process accepted their records, so delivery is at least once.
+type Listener struct {
+	Addr     string
+	Process  func([]common.LogEvent) error
+	MaxBytes int64 // max size of a message, and of its decompressed entries, 0 for no limit
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func NewListener(addr string, maxBytes int64, process func([]common.LogEvent) error) *Listener {
+	return &Listener{
+		Addr:     addr,
+		Process:  process,
+		MaxBytes: maxBytes,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+func (l *Listener) ListenAndServe() error {
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return err
+	}
+	return l.Serve(ln)
+}
+
+// Accept connections on ln until the listener is closed
+func (l *Listener) Serve(ln net.Listener) error {
+	l.mu.Lock()
+	l.ln = ln
+	l.mu.Unlock()
+
+	slog.Info(fmt.Sprintf("Forward listener on %s", ln.Addr()))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		l.mu.Lock()
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.serveConn(conn)
+
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+// Stop accepting connections, close the open ones and wait for the
+// messages being processed
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	var err error
+	if l.ln != nil {
+		err = l.ln.Close()
+	}
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return err
+}
+
+func (l *Listener) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	dec := newMessageDecoder(conn, l.MaxBytes)
+	enc := msgpack.NewEncoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := dec.next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn(fmt.Sprintf("Closing forward connection from %s: %s", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		if msg.Invalid > 0 {
+			slog.Warn(fmt.Sprintf("Skipped %d invalid records tagged %s", msg.Invalid, msg.Tag))
+		}
+
+		if err := l.Process(msg.Events); err != nil {
+			slog.Warn(fmt.Sprintf("Closing forward connection from %s: %s", conn.RemoteAddr(), err))
+			return
+		}
+
+		if msg.Options.Chunk != "" {
+			if err := enc.Encode(map[string]string{"ack": msg.Options.Chunk}); err != nil {
+				slog.Warn(fmt.Sprintf("Failed to ack forward chunk: %s", err))
+				return
+			}
+		}
+	}
+}
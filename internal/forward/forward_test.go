@@ -0,0 +1,213 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"log-analyzer/internal/common"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// EventTime extension as sent by Fluent Bit
+type eventTime time.Time
+
+func init() {
+	msgpack.RegisterExtEncoder(eventTimeExt, eventTime{}, func(_ *msgpack.Encoder, v reflect.Value) ([]byte, error) {
+		t := time.Time(v.Interface().(eventTime))
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+		binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+		return b, nil
+	})
+}
+
+type record map[string]any
+
+func entry(t *testing.T, ts time.Time, log string) []byte {
+	t.Helper()
+	b, err := msgpack.Marshal([]any{eventTime(ts), record{
+		"log":        log,
+		"kubernetes": record{"pod_id": "pod-1", "container_name": "app"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestListenerModes(t *testing.T) {
+	ts := time.Date(2025, 11, 24, 13, 0, 0, 123456789, time.UTC)
+	packed := append(entry(t, ts, "first"), entry(t, ts.Add(time.Second), "second")...)
+
+	tests := []struct {
+		name    string
+		message []any
+		want    []string
+	}{
+		{
+			name:    "message",
+			message: []any{"app", eventTime(ts), record{"log": "first"}, record{"chunk": "c1"}},
+			want:    []string{"first"},
+		},
+		{
+			name: "forward",
+			message: []any{"app", []any{
+				[]any{eventTime(ts), record{"log": "first"}},
+				[]any{[]any{eventTime(ts.Add(time.Second)), record{}}, record{"log": "second"}},
+			}, record{"chunk": "c2"}},
+			want: []string{"first", "second"},
+		},
+		{
+			name:    "packed forward",
+			message: []any{"app", packed, record{"chunk": "c3", "size": 2}},
+			want:    []string{"first", "second"},
+		},
+		{
+			name:    "compressed packed forward",
+			message: []any{"app", gzipped(t, packed), record{"chunk": "c4", "size": 2, "compressed": "gzip"}},
+			want:    []string{"first", "second"},
+		},
+	}
+
+	received := make(chan []common.LogEvent, len(tests))
+	l := NewListener("127.0.0.1:0", 1024*1024, func(events []common.LogEvent) error {
+		received <- events
+		return nil
+	})
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve(ln)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	enc := msgpack.NewEncoder(conn)
+	dec := msgpack.NewDecoder(conn)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := enc.Encode(tt.message); err != nil {
+				t.Fatal(err)
+			}
+
+			var ack map[string]string
+			if err := dec.Decode(&ack); err != nil {
+				t.Fatal(err)
+			}
+			chunk := tt.message[len(tt.message)-1].(record)["chunk"]
+			if ack["ack"] != chunk {
+				t.Fatalf("got ack %v, want %v", ack, chunk)
+			}
+
+			events := <-received
+			if len(events) != len(tt.want) {
+				t.Fatalf("got %d events, want %d", len(events), len(tt.want))
+			}
+			for i, le := range events {
+				if le.Log != tt.want[i] {
+					t.Errorf("event %d: got log %q, want %q", i, le.Log, tt.want[i])
+				}
+				if want := ts.Add(time.Duration(i) * time.Second); !le.Timestamp().Equal(want) {
+					t.Errorf("event %d: got time %s, want %s", i, le.Timestamp(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestListenerPackedMetadata(t *testing.T) {
+	ts := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	if err := enc.Encode([]any{"app", entry(t, ts, "line")}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := decodeMessage(msgpack.NewDecoder(&buf), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Events) != 1 {
+		t.Fatalf("got %d events, want 1", len(msg.Events))
+	}
+	meta := msg.Events[0].K8sMetadata
+	if meta.PodID != "pod-1" || meta.ContainerName != "app" {
+		t.Fatalf("got metadata %+v, want pod-1/app", meta)
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	ts := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+	line := string(bytes.Repeat([]byte("x"), 100))
+	packed := append(entry(t, ts, line), entry(t, ts, line)...)
+
+	tests := []struct {
+		name    string
+		message []any
+		err     bool
+	}{
+		{name: "message", message: []any{"app", eventTime(ts), record{"log": "a"}}},
+		{name: "large message", message: []any{"app", eventTime(ts), record{"log": line + line}}, err: true},
+		{name: "large forward", message: []any{"app", []any{
+			[]any{eventTime(ts), record{"log": line}},
+			[]any{eventTime(ts), record{"log": line}},
+		}}, err: true},
+		{name: "large packed forward", message: []any{"app", packed}, err: true},
+		{name: "large compressed packed forward", message: []any{"app", gzipped(t, packed), record{"compressed": "gzip"}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A message of the size limit follows, it isn't counted against
+			// the one before
+			var buf bytes.Buffer
+			enc := msgpack.NewEncoder(&buf)
+			if err := enc.Encode(tt.message); err != nil {
+				t.Fatal(err)
+			}
+			small := []any{"app", eventTime(ts), record{"log": "b"}}
+			if err := enc.Encode(small); err != nil {
+				t.Fatal(err)
+			}
+
+			dec := newMessageDecoder(&buf, 150)
+			_, err := dec.next()
+			if tt.err {
+				if !errors.Is(err, errMessageTooLarge) {
+					t.Fatalf("got error %v, want the message over the size limit", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := dec.next()
+			if err != nil || len(msg.Events) != 1 || msg.Events[0].Log != "b" {
+				t.Fatalf("got %+v, %v decoding the next message, want the event logging b", msg, err)
+			}
+		})
+	}
+}
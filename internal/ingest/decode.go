@@ -0,0 +1,109 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log-analyzer/internal/common"
+	"log/slog"
+)
+
+const (
+	MaxLineSize = 1024 * 1024
+)
+
+// Framings of JSON encoded log events
+const (
+	FormatJSON   = "json"   // JSON array of fluentbit log events
+	FormatNDJSON = "ndjson" // one fluentbit log event per line
+)
+
+// Guess the framing of JSON encoded log events from the first non-space
+// character, a single object is read as NDJSON
+func DetectJSONFormat(br *bufio.Reader) string {
+	if c, _ := PeekNonSpace(br); c == '[' {
+		return FormatJSON
+	}
+	return FormatNDJSON
+}
+
+// Return the first non-space byte of br without consuming it, false if
+// there is none within the first 4096 bytes
+func PeekNonSpace(br *bufio.Reader) (byte, bool) {
+	for i := 1; i <= 4096; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return 0, false
+		}
+		switch c := b[i-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// Decode a JSON array of log events incrementally and feed each of them to
+// process, along with its position: the number of events before it, whether
+// they decoded or not. Events that don't decode are skipped, decoding stops
+// at the first error of process.
+// Returns the number of events processed and rejected
+func DecodeJSONArray(r io.Reader, process func(le common.LogEvent, pos int) error) (int, int, error) {
+	n, rejected := 0, 0
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return n, rejected, err
+	} else if tok != json.Delim('[') {
+		return n, rejected, fmt.Errorf("expected a JSON array, got %v", tok)
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return n, rejected, err
+		}
+
+		var le common.LogEvent
+		if err := json.Unmarshal(raw, &le); err != nil {
+			slog.Warn(fmt.Sprintf("Skipping invalid log event: %s", err))
+			rejected++
+			continue
+		}
+		if err := process(le, n+rejected); err != nil {
+			return n, rejected, err
+		}
+		n++
+	}
+	return n, rejected, nil
+}
+
+// Decode newline-delimited log events and feed each of them to process,
+// along with its position like DecodeJSONArray. Lines that don't decode are
+// skipped, decoding stops at the first error of process.
+// Returns the number of events processed and rejected
+func DecodeNDJSON(r io.Reader, process func(le common.LogEvent, pos int) error) (int, int, error) {
+	n, rejected := 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var le common.LogEvent
+		if err := json.Unmarshal(line, &le); err != nil {
+			slog.Warn(fmt.Sprintf("Skipping invalid log event: %s", err))
+			rejected++
+			continue
+		}
+		if err := process(le, n+rejected); err != nil {
+			return n, rejected, err
+		}
+		n++
+	}
+	return n, rejected, scanner.Err()
+}
@@ -0,0 +1,234 @@
+package ingest
+
+import (
+	"log-analyzer/internal/common"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const exceptionSuffix = `(?:Exception|Error|Throwable|Exit|Interrupt|Warning)`
+
+// Stack trace shapes of the common runtimes
+var (
+	// Go
+	goPanicStart   = regexp.MustCompile(`^(?:panic|fatal error): (.+?)(?: \[recovered\])?$`)
+	goGoroutine    = regexp.MustCompile(`^goroutine \d+ \[[^\]]+\]:$`)
+	goFunc         = regexp.MustCompile(`^((?:[\w./-]+/)?[\w.()*\[\]-]+)\(.*\)$`)
+	goFileLine     = regexp.MustCompile(`^\t\S+\.go:\d+`)
+	goContinuation = regexp.MustCompile(`^(?:\[signal .*\]|created by .+|exit status \d+|\s*)$`)
+
+	// Java and Node exception header. The type is a qualified class name, or
+	// an identifier ending in a suffix of its own, so that log lines like
+	// "Error: connection refused" don't start a trace
+	exceptionStart = regexp.MustCompile(`^(?:Exception in thread "[^"]*" )?((?:[\w$]+\.)+[\w$]*` + exceptionSuffix + `|[\w$]+` + exceptionSuffix + `)(?::\s?.*)?$`)
+	// Java
+	javaFrame        = regexp.MustCompile(`^\s+at ([\w$.<>/]+)\(.*\)$`)
+	javaContinuation = regexp.MustCompile(`^(?:\s*\.\.\. \d+ (?:more|common frames omitted)|Caused by: .+|\s+Suppressed: .+)$`)
+	// Node
+	nodeFrame = regexp.MustCompile(`^\s+at (?:async )?(?:([^\s(]+) \(.*\)|(\S+?)(?::\d+)*)$`)
+	// Python
+	pythonStart        = regexp.MustCompile(`^Traceback \(most recent call last\):$`)
+	pythonFrame        = regexp.MustCompile(`^\s+File "([^"]+)", line \d+, in (\S+)$`)
+	pythonContinuation = regexp.MustCompile(`^(?:\s{4,}.*|\s*\^+\s*|During handling of the above exception.*|The above exception was the direct cause.*|\s*)$`)
+	// Last line of a traceback, its type may be a bare suffix like "Exception"
+	pythonException = regexp.MustCompile(`^((?:[\w$]+\.)*[\w$]*` + exceptionSuffix + `)(?::\s?.*)?$`)
+)
+
+type traceKind int
+
+const (
+	traceGo traceKind = iota
+	traceException
+	tracePython
+)
+
+// MultilineGrouper collapses the lines of a Go panic, or a Java, Python or
+// Node exception, logged as one event per line, into a single event keyed
+// on the exception type and the frame it was raised in, e.g.
+// "exception java.lang.NullPointerException at com.foo.Bar.baz".
+// Lines are grouped per pod, container and stream. A trace is released once
+// a line that doesn't belong to it arrives, after Timeout without a new line,
+// or once it reaches MaxLines.
+type MultilineGrouper struct {
+	Timeout  time.Duration
+	MaxLines int
+
+	mu      sync.Mutex
+	pending map[string]*trace // stream key to trace being grouped
+}
+
+type trace struct {
+	kind      traceKind
+	first     common.LogEvent // header event, its metadata and time are kept
+	excType   string
+	topFrame  string
+	lines     int
+	updatedAt time.Time // wall-clock time of the last line
+}
+
+func NewMultilineGrouper(timeout time.Duration, maxLines int) *MultilineGrouper {
+	return &MultilineGrouper{
+		Timeout:  timeout,
+		MaxLines: maxLines,
+		pending:  make(map[string]*trace),
+	}
+}
+
+func (mg *MultilineGrouper) Add(le common.LogEvent) []common.LogEvent {
+	key := streamKey(le)
+	line := strings.TrimRight(le.Log, "\r\n")
+
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	var out []common.LogEvent
+	if t, ok := mg.pending[key]; ok {
+		if t.add(line) {
+			t.updatedAt = time.Now()
+			if t.done() || (mg.MaxLines > 0 && t.lines >= mg.MaxLines) {
+				delete(mg.pending, key)
+				out = append(out, t.events()...)
+			}
+			return out
+		}
+		// The trace ended with the previous line
+		delete(mg.pending, key)
+		out = append(out, t.events()...)
+	}
+
+	if t := startTrace(le, line); t != nil {
+		mg.pending[key] = t
+		return out
+	}
+	return append(out, le)
+}
+
+func (mg *MultilineGrouper) Expire(now time.Time, owns func(common.LogEvent) bool) []common.LogEvent {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	var out []common.LogEvent
+	for key, t := range mg.pending {
+		if now.Sub(t.updatedAt) >= mg.Timeout && owns(t.first) {
+			delete(mg.pending, key)
+			out = append(out, t.events()...)
+		}
+	}
+	return out
+}
+
+func (mg *MultilineGrouper) Flush() []common.LogEvent {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	var out []common.LogEvent
+	for key, t := range mg.pending {
+		delete(mg.pending, key)
+		out = append(out, t.events()...)
+	}
+	return out
+}
+
+// Return a trace if the line looks like the start of one
+func startTrace(le common.LogEvent, line string) *trace {
+	t := &trace{first: le, lines: 1, updatedAt: time.Now()}
+	switch {
+	case goPanicStart.MatchString(line):
+		t.kind = traceGo
+		t.excType = goPanicStart.FindStringSubmatch(line)[1]
+	case pythonStart.MatchString(line):
+		t.kind = tracePython
+	case exceptionStart.MatchString(line):
+		t.kind = traceException
+		t.excType = exceptionStart.FindStringSubmatch(line)[1]
+	default:
+		return nil
+	}
+	return t
+}
+
+// Add the line to the trace if it belongs to it
+func (t *trace) add(line string) bool {
+	switch t.kind {
+	case traceGo:
+		if goGoroutine.MatchString(line) || goFileLine.MatchString(line) || goContinuation.MatchString(line) {
+			break
+		}
+		m := goFunc.FindStringSubmatch(line)
+		if m == nil {
+			return false
+		}
+		// Skip the runtime's own frames of a re-raised panic
+		if t.topFrame == "" && !strings.HasPrefix(m[1], "panic") && !strings.HasPrefix(m[1], "runtime.") {
+			t.topFrame = m[1]
+		}
+
+	case traceException:
+		if m := javaFrame.FindStringSubmatch(line); m != nil {
+			if t.topFrame == "" {
+				t.topFrame = m[1]
+			}
+			break
+		}
+		if m := nodeFrame.FindStringSubmatch(line); m != nil {
+			if t.topFrame == "" {
+				t.topFrame = m[1]
+				if t.topFrame == "" {
+					t.topFrame = path.Base(m[2])
+				}
+			}
+			break
+		}
+		if !javaContinuation.MatchString(line) {
+			return false
+		}
+
+	case tracePython:
+		// The most recent call is listed last
+		if m := pythonFrame.FindStringSubmatch(line); m != nil {
+			t.topFrame = m[2] + " (" + path.Base(m[1]) + ")"
+			break
+		}
+		if m := pythonException.FindStringSubmatch(line); m != nil && t.topFrame != "" {
+			t.excType = m[1]
+			break
+		}
+		if !pythonContinuation.MatchString(line) {
+			return false
+		}
+	}
+
+	t.lines++
+	return true
+}
+
+// Python traces end with the exception line
+func (t *trace) done() bool {
+	return t.kind == tracePython && t.excType != ""
+}
+
+// Return the trace as a single event, or its header event as it was if no
+// line ever followed it
+func (t *trace) events() []common.LogEvent {
+	if t.lines == 1 {
+		return []common.LogEvent{t.first}
+	}
+
+	le := t.first
+	kind := "exception"
+	if t.kind == traceGo {
+		kind = "panic"
+	}
+	excType := t.excType
+	if excType == "" {
+		excType = "unknown"
+	}
+	le.Log = kind + " " + excType
+	if t.topFrame != "" {
+		le.Log += " at " + t.topFrame
+	}
+	return []common.LogEvent{le}
+}
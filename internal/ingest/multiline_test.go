@@ -0,0 +1,146 @@
+package ingest
+
+import (
+	"fmt"
+	"log-analyzer/internal/common"
+	"strings"
+	"testing"
+	"time"
+)
+
+func all(common.LogEvent) bool { return true }
+
+func logs(events []common.LogEvent) []string {
+	out := make([]string, len(events))
+	for i, le := range events {
+		out[i] = le.Log
+	}
+	return out
+}
+
+func TestMultilineGrouper(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  string // one event per line
+		expire bool   // release what is held back by a timeout at the end
+		want   []string
+	}{
+		{
+			name: "java",
+			lines: `Exception in thread "main" java.lang.IllegalStateException: boom
+	at com.foo.Bar.baz(Bar.java:42)
+	at com.foo.Main.main(Main.java:10)
+Caused by: java.io.IOException: disk full
+	at com.foo.Disk.write(Disk.java:7)
+	... 2 more
+next line`,
+			want: []string{"exception java.lang.IllegalStateException at com.foo.Bar.baz", "next line"},
+		},
+		{
+			name: "python",
+			lines: `Traceback (most recent call last):
+  File "/app/main.py", line 10, in <module>
+    main()
+  File "/app/db.py", line 42, in connect
+    raise ConnectionError("refused")
+ConnectionError: refused
+next line`,
+			want: []string{"exception ConnectionError at connect (db.py)", "next line"},
+		},
+		{
+			name: "python bare exception",
+			lines: `Traceback (most recent call last):
+  File "/app/main.py", line 3, in <module>
+    raise Exception("boom")
+Exception: boom`,
+			want: []string{"exception Exception at <module> (main.py)"},
+		},
+		{
+			name: "go",
+			lines: `panic: runtime error: index out of range [3] with length 2
+
+goroutine 1 [running]:
+main.handler(0xc000012345)
+	/app/main.go:42 +0x1d
+main.main()
+	/app/main.go:10 +0x25
+exit status 2
+next line`,
+			want: []string{"panic runtime error: index out of range [3] with length 2 at main.handler", "next line"},
+		},
+		{
+			name: "node",
+			lines: `TypeError: Cannot read properties of undefined (reading 'id')
+    at getUser (/app/users.js:12:20)
+    at async /app/server.js:30:5
+next line`,
+			want: []string{"exception TypeError at getUser", "next line"},
+		},
+		// Passed on right away, not held back as the start of a trace
+		{name: "plain error line", lines: "Error: connection refused", want: []string{"Error: connection refused"}},
+		{name: "plain warning line", lines: "Warning: disk 91%", want: []string{"Warning: disk 91%"}},
+		{
+			name:   "timeout",
+			lines:  "java.lang.NullPointerException\n\tat com.foo.Bar.baz(Bar.java:42)",
+			expire: true,
+			want:   []string{"exception java.lang.NullPointerException at com.foo.Bar.baz"},
+		},
+		{
+			name:   "timeout of a lone header",
+			lines:  "java.lang.NullPointerException: id",
+			expire: true,
+			want:   []string{"java.lang.NullPointerException: id"},
+		},
+		{
+			name:  "header followed by a plain line",
+			lines: "ValueError: bad id\nnext line",
+			want:  []string{"ValueError: bad id", "next line"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mg := NewMultilineGrouper(time.Minute, 500)
+			var out []common.LogEvent
+			for _, line := range strings.Split(tt.lines, "\n") {
+				out = append(out, mg.Add(common.LogEvent{Log: line})...)
+			}
+			if tt.expire {
+				out = append(out, mg.Expire(time.Now().Add(time.Minute), all)...)
+			}
+			if got := logs(out); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if held := mg.Flush(); len(held) > 0 {
+				t.Fatalf("got %q held back, want none", logs(held))
+			}
+		})
+	}
+}
+
+func TestMultilineGrouperStreams(t *testing.T) {
+	mg := NewMultilineGrouper(time.Minute, 3)
+	a := common.LogEvent{Stream: "stderr", K8sMetadata: common.K8sMetadata{PodID: "pod-1", ContainerName: "api"}}
+	b := common.LogEvent{Stream: "stderr", K8sMetadata: common.K8sMetadata{PodID: "pod-2", ContainerName: "api"}}
+	add := func(le common.LogEvent, line string) []string {
+		le.Log = line
+		return logs(mg.Add(le))
+	}
+
+	// Lines of two pods interleave, each stream is grouped on its own
+	add(a, "java.lang.IllegalStateException: a")
+	add(b, "java.lang.IllegalArgumentException: b")
+	add(a, "\tat com.foo.A.run(A.java:1)")
+	add(b, "\tat com.foo.B.run(B.java:1)")
+
+	// Only the streams owned are expired
+	owns := func(le common.LogEvent) bool { return le.K8sMetadata.PodID == "pod-2" }
+	if got := logs(mg.Expire(time.Now().Add(time.Minute), owns)); fmt.Sprint(got) != "[exception java.lang.IllegalArgumentException at com.foo.B.run]" {
+		t.Fatalf("got %q expired, want the trace of pod-2", got)
+	}
+
+	// MaxLines releases the trace
+	if got := add(a, "\tat com.foo.Main.main(Main.java:1)"); fmt.Sprint(got) != "[exception java.lang.IllegalStateException at com.foo.A.run]" {
+		t.Fatalf("got %q, want the trace of pod-1 released at 3 lines", got)
+	}
+}
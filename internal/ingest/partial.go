@@ -0,0 +1,120 @@
+package ingest
+
+import (
+	"fmt"
+	"log-analyzer/internal/common"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CRI log tags, carried by fluentbit in the _p field
+const (
+	criPartial = "P" // line continues in the next record
+	criFull    = "F" // last, or only, record of a line
+)
+
+// Reassembler joins CRI partial lines, split by the container runtime, back
+// into the full log line. Fragments are buffered per pod, container and
+// stream until the F record arrives. Lines are released as they are after
+// Timeout without a new fragment, and cut at MaxBytes.
+type Reassembler struct {
+	Timeout  time.Duration
+	MaxBytes int
+
+	mu      sync.Mutex
+	pending map[string]*partialLine // stream key to line being joined
+}
+
+type partialLine struct {
+	first     common.LogEvent // first fragment, its metadata and time are kept
+	buf       strings.Builder
+	truncated bool
+	updatedAt time.Time // wall-clock time of the last fragment
+}
+
+func NewReassembler(timeout time.Duration, maxBytes int) *Reassembler {
+	return &Reassembler{
+		Timeout:  timeout,
+		MaxBytes: maxBytes,
+		pending:  make(map[string]*partialLine),
+	}
+}
+
+func (r *Reassembler) Add(le common.LogEvent) []common.LogEvent {
+	if le.Partial != criPartial && le.Partial != criFull {
+		return []common.LogEvent{le}
+	}
+
+	key := streamKey(le)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pl, ok := r.pending[key]
+	if !ok {
+		// Whole line in a single record
+		if le.Partial == criFull {
+			return []common.LogEvent{le}
+		}
+		pl = &partialLine{first: le}
+		r.pending[key] = pl
+	}
+	pl.append(le.Log, r.MaxBytes)
+	pl.updatedAt = time.Now()
+
+	if le.Partial == criPartial {
+		return nil
+	}
+	delete(r.pending, key)
+	return []common.LogEvent{pl.event()}
+}
+
+func (r *Reassembler) Expire(now time.Time, owns func(common.LogEvent) bool) []common.LogEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []common.LogEvent
+	for key, pl := range r.pending {
+		if now.Sub(pl.updatedAt) < r.Timeout || !owns(pl.first) {
+			continue
+		}
+		slog.Debug(fmt.Sprintf("Partial line of %s timed out without its final record", pl.first.K8sMetadata.Workload()))
+		delete(r.pending, key)
+		out = append(out, pl.event())
+	}
+	return out
+}
+
+func (r *Reassembler) Flush() []common.LogEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []common.LogEvent
+	for key, pl := range r.pending {
+		delete(r.pending, key)
+		out = append(out, pl.event())
+	}
+	return out
+}
+
+func (pl *partialLine) append(s string, maxBytes int) {
+	if pl.truncated {
+		return
+	}
+	if maxBytes > 0 && pl.buf.Len()+len(s) > maxBytes {
+		s = strings.ToValidUTF8(s[:maxBytes-pl.buf.Len()], "")
+		pl.truncated = true
+		slog.Debug(fmt.Sprintf("Partial line of %s exceeds %d bytes, truncating", pl.first.K8sMetadata.Workload(), maxBytes))
+	}
+	pl.buf.WriteString(s)
+}
+
+// The reassembled line as a single full event
+func (pl *partialLine) event() common.LogEvent {
+	le := pl.first
+	le.Log = pl.buf.String()
+	le.Partial = criFull
+	return le
+}
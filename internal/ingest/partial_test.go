@@ -0,0 +1,95 @@
+package ingest
+
+import (
+	"fmt"
+	"log-analyzer/internal/common"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReassembler(t *testing.T) {
+	// Fragments as "tag:log", of the stream of pod-1 unless prefixed with 2
+	tests := []struct {
+		name     string
+		maxBytes int
+		records  []string
+		expire   bool // release what is held back by a timeout at the end
+		want     []string
+	}{
+		{
+			name:    "partial lines",
+			records: []string{"P:GET /users", "P:?id=1", "F: 200"},
+			want:    []string{"GET /users?id=1 200"},
+		},
+		{
+			name:    "full lines",
+			records: []string{"F:a", ":b", "F:c"},
+			want:    []string{"a", "b", "c"},
+		},
+		{
+			name:    "streams",
+			records: []string{"P:a1", "2P:b1", "2F:b2", "F:a2"},
+			want:    []string{"b1b2", "a1a2"},
+		},
+		{
+			name:     "max bytes",
+			maxBytes: 5,
+			records:  []string{"P:abc", "P:def", "F:ghi"},
+			want:     []string{"abcde"},
+		},
+		{
+			name:    "timeout",
+			records: []string{"P:abc", "P:def"},
+			expire:  true,
+			want:    []string{"abcdef"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler(time.Minute, tt.maxBytes)
+			var out []common.LogEvent
+			for _, rec := range tt.records {
+				le := common.LogEvent{K8sMetadata: common.K8sMetadata{PodID: "pod-1"}}
+				if rec[0] == '2' {
+					le.K8sMetadata.PodID = "pod-2"
+					rec = rec[1:]
+				}
+				le.Partial, le.Log, _ = strings.Cut(rec, ":")
+				out = append(out, r.Add(le)...)
+			}
+			if tt.expire {
+				out = append(out, r.Expire(time.Now().Add(time.Minute), all)...)
+			}
+			if got := logs(out); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for _, le := range out {
+				if le.Partial == criPartial {
+					t.Fatalf("got a partial event %+v, want full ones", le)
+				}
+			}
+			if held := r.Flush(); len(held) > 0 {
+				t.Fatalf("got %q held back, want none", logs(held))
+			}
+		})
+	}
+}
+
+func TestReassemblerExpire(t *testing.T) {
+	r := NewReassembler(time.Minute, 0)
+	r.Add(common.LogEvent{Log: "a", Partial: criPartial, K8sMetadata: common.K8sMetadata{PodID: "pod-1"}})
+	r.Add(common.LogEvent{Log: "b", Partial: criPartial, K8sMetadata: common.K8sMetadata{PodID: "pod-2"}})
+
+	if got := r.Expire(time.Now(), all); len(got) > 0 {
+		t.Fatalf("got %q expired before the timeout, want none", logs(got))
+	}
+	owns := func(le common.LogEvent) bool { return le.K8sMetadata.PodID == "pod-2" }
+	if got := logs(r.Expire(time.Now().Add(time.Minute), owns)); fmt.Sprint(got) != "[b]" {
+		t.Fatalf("got %q expired, want the line of pod-2 only", got)
+	}
+	if got := logs(r.Flush()); fmt.Sprint(got) != "[a]" {
+		t.Fatalf("got %q flushed, want the line of pod-1", got)
+	}
+}
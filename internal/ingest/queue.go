@@ -0,0 +1,243 @@
+package ingest
+
+import (
+	"errors"
+	"hash/fnv"
+	"log-analyzer/internal/common"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQueueFull     = errors.New("ingest queue is full")
+	ErrQueueClosed   = errors.New("ingest queue is closed")
+	ErrBatchTooLarge = errors.New("batch is larger than the ingest queue can hold, send smaller batches")
+)
+
+// Queue decouples receiving log events from processing them. Events are
+// sharded by stream over a fixed pool of workers, so the lines of a stream
+// are still processed in order, and each shard is bounded.
+// Work on the held back events of a stream, like releasing them after a
+// timeout, runs on ticks between the events of its shard, to stay in order
+// with them.
+type Queue struct {
+	process func(common.LogEvent)
+	tick    func(now time.Time, owns func(common.LogEvent) bool)
+	ticks   []chan time.Time // per shard
+
+	mu     sync.Mutex
+	space  *sync.Cond // signalled when events are dequeued
+	closed bool
+	shards []chan queued
+	wg     sync.WaitGroup
+
+	enqueued  atomic.Int64
+	processed atomic.Int64
+	rejected  atomic.Int64
+	lag       []atomic.Int64 // per shard, nanoseconds the last event waited
+}
+
+type queued struct {
+	le         common.LogEvent
+	enqueuedAt time.Time
+}
+
+// Snapshot of the queue for metrics
+type QueueStats struct {
+	Depth     int
+	Capacity  int
+	Workers   int
+	Enqueued  int64         // events accepted since start
+	Processed int64         // events processed since start
+	Rejected  int64         // events turned away because the queue was full
+	Lag       time.Duration // longest wait of the events being processed
+}
+
+// Create a queue of size events processed by the given number of workers
+func NewQueue(size, workers int, process func(common.LogEvent)) *Queue {
+	workers = max(workers, 1)
+	shardSize := max(size/workers, 1)
+	q := &Queue{
+		process: process,
+		shards:  make([]chan queued, workers),
+		ticks:   make([]chan time.Time, workers),
+		lag:     make([]atomic.Int64, workers),
+	}
+	q.space = sync.NewCond(&q.mu)
+	for i := range q.shards {
+		q.shards[i] = make(chan queued, shardSize)
+		q.ticks[i] = make(chan time.Time, 1)
+	}
+	return q
+}
+
+// Set the function each worker runs on Tick, given which events belong to
+// the streams of its shard. Must be called before Start
+func (q *Queue) OnTick(tick func(now time.Time, owns func(common.LogEvent) bool)) {
+	q.tick = tick
+}
+
+// Have every worker run the tick function at wall-clock time now, between
+// two events. A worker still busy with the previous tick skips this one
+func (q *Queue) Tick(now time.Time) {
+	for _, ticks := range q.ticks {
+		select {
+		case ticks <- now:
+		default:
+		}
+	}
+}
+
+func (q *Queue) Start() {
+	for i, shard := range q.shards {
+		owns := func(le common.LogEvent) bool { return q.shard(le) == i }
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for {
+				select {
+				case now := <-q.ticks[i]:
+					if q.tick != nil {
+						q.tick(now, owns)
+					}
+				case item, ok := <-shard:
+					if !ok {
+						return
+					}
+					q.processItem(i, item)
+				}
+			}
+		}()
+	}
+}
+
+func (q *Queue) processItem(i int, item queued) {
+	q.lag[i].Store(int64(time.Since(item.enqueuedAt)))
+	q.process(item.le)
+	q.processed.Add(1)
+	if len(q.shards[i]) == 0 {
+		q.lag[i].Store(0)
+	}
+
+	// Under the lock, so a waiting Enqueue can't miss it
+	q.mu.Lock()
+	q.space.Broadcast()
+	q.mu.Unlock()
+}
+
+// Enqueue all events, or none of them if they don't fit. A batch too large
+// to ever fit is turned away with ErrBatchTooLarge
+func (q *Queue) TryEnqueue(events []common.LogEvent) error {
+	return q.enqueueAll(events, false)
+}
+
+// Enqueue all events at once, waiting until there is room for all of them.
+// Unlike Enqueue, none of the events are queued if the queue is closed while
+// waiting. A batch too large to ever fit is turned away with ErrBatchTooLarge
+func (q *Queue) EnqueueAll(events []common.LogEvent) error {
+	return q.enqueueAll(events, true)
+}
+
+// Largest batch sure to fit in the queue once it drains, whatever the
+// streams of its events
+func (q *Queue) MaxBatch() int {
+	return cap(q.shards[0])
+}
+
+func (q *Queue) enqueueAll(events []common.LogEvent, wait bool) error {
+	need := make([]int, len(q.shards))
+	for _, le := range events {
+		need[q.shard(le)]++
+	}
+	for i, n := range need {
+		if n > cap(q.shards[i]) {
+			q.rejected.Add(int64(len(events)))
+			return ErrBatchTooLarge
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return ErrQueueClosed
+		}
+		full := false
+		for i, n := range need {
+			if len(q.shards[i])+n > cap(q.shards[i]) {
+				full = true
+				break
+			}
+		}
+		if !full {
+			break
+		}
+		if !wait {
+			q.rejected.Add(int64(len(events)))
+			return ErrQueueFull
+		}
+		q.space.Wait()
+	}
+
+	now := time.Now()
+	for _, le := range events {
+		q.shards[q.shard(le)] <- queued{le: le, enqueuedAt: now}
+	}
+	q.enqueued.Add(int64(len(events)))
+	return nil
+}
+
+// Enqueue all events, waiting for room as needed
+func (q *Queue) Enqueue(events []common.LogEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, le := range events {
+		shard := q.shards[q.shard(le)]
+		for !q.closed && len(shard) == cap(shard) {
+			q.space.Wait()
+		}
+		if q.closed {
+			return ErrQueueClosed
+		}
+		shard <- queued{le: le, enqueuedAt: time.Now()}
+		q.enqueued.Add(1)
+	}
+	return nil
+}
+
+// Stop accepting events and wait for the queued ones to be processed
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.space.Broadcast()
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+func (q *Queue) Stats() QueueStats {
+	st := QueueStats{
+		Workers:   len(q.shards),
+		Enqueued:  q.enqueued.Load(),
+		Processed: q.processed.Load(),
+		Rejected:  q.rejected.Load(),
+	}
+	for i, shard := range q.shards {
+		st.Depth += len(shard)
+		st.Capacity += cap(shard)
+		st.Lag = max(st.Lag, time.Duration(q.lag[i].Load()))
+	}
+	return st
+}
+
+func (q *Queue) shard(le common.LogEvent) int {
+	h := fnv.New32a()
+	h.Write([]byte(streamKey(le)))
+	return int(h.Sum32() % uint32(len(q.shards)))
+}
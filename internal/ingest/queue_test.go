@@ -0,0 +1,86 @@
+package ingest
+
+import (
+	"fmt"
+	"log-analyzer/internal/common"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueTick(t *testing.T) {
+	events := make([]common.LogEvent, 10)
+	for i := range events {
+		events[i] = common.LogEvent{Log: "a", K8sMetadata: common.K8sMetadata{PodID: fmt.Sprint("pod-", i)}}
+	}
+	blocked := events[0].K8sMetadata.PodID
+
+	release := make(chan struct{})
+	q := NewQueue(100, 4, func(le common.LogEvent) {
+		if le.K8sMetadata.PodID == blocked {
+			<-release
+		}
+	})
+
+	var mu sync.Mutex
+	owners := make(map[string]int) // pod to the number of workers owning it
+	ticked := 0
+	tickedBlocked := false
+	q.OnTick(func(now time.Time, owns func(common.LogEvent) bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		ticked++
+		for _, le := range events {
+			if owns(le) {
+				owners[le.K8sMetadata.PodID]++
+				tickedBlocked = tickedBlocked || le.K8sMetadata.PodID == blocked
+			}
+		}
+	})
+	q.Start()
+	defer q.Close()
+
+	if err := q.TryEnqueue(events[:1]); err != nil {
+		t.Fatal(err)
+	}
+	// Picked up by its worker
+	for q.Stats().Depth > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.Tick(time.Now())
+
+	waitTicks := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			got := ticked
+			mu.Unlock()
+			if got >= n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d ticks, want %d", got, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The worker busy with the event of the stream ticks once done with it
+	waitTicks(3)
+	mu.Lock()
+	if tickedBlocked {
+		t.Fatal("the stream of the event being processed was ticked by another worker")
+	}
+	mu.Unlock()
+
+	close(release)
+	waitTicks(4)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, le := range events {
+		if n := owners[le.K8sMetadata.PodID]; n != 1 {
+			t.Errorf("%s: got %d workers owning it, want 1", le.K8sMetadata.PodID, n)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ingest
+
+import (
+	"log-analyzer/internal/common"
+	"time"
+)
+
+// Stage transforms the stream of log events ahead of the parser, e.g. by
+// joining several events into one. Stages may hold events back, and must be
+// safe for concurrent use.
+type Stage interface {
+	// Add an event, returns the events ready to be passed on
+	Add(le common.LogEvent) []common.LogEvent
+	// Release events held back for too long at wall-clock time now, of the
+	// streams whose events owns accepts
+	Expire(now time.Time, owns func(common.LogEvent) bool) []common.LogEvent
+	// Release all events held back
+	Flush() []common.LogEvent
+}
+
+// Chain runs events through stages in order
+type Chain []Stage
+
+func (c Chain) Add(le common.LogEvent) []common.LogEvent {
+	return c.pass(0, []common.LogEvent{le})
+}
+
+// Events released by a stage still go through the stages after it
+func (c Chain) Expire(now time.Time, owns func(common.LogEvent) bool) []common.LogEvent {
+	var out []common.LogEvent
+	for i, st := range c {
+		out = append(c.pass(i+1, out), st.Expire(now, owns)...)
+	}
+	return out
+}
+
+func (c Chain) Flush() []common.LogEvent {
+	var out []common.LogEvent
+	for i, st := range c {
+		out = append(c.pass(i+1, out), st.Flush()...)
+	}
+	return out
+}
+
+// Run events through the stages from i on
+func (c Chain) pass(i int, events []common.LogEvent) []common.LogEvent {
+	for _, st := range c[i:] {
+		var next []common.LogEvent
+		for _, le := range events {
+			next = append(next, st.Add(le)...)
+		}
+		events = next
+	}
+	return events
+}
+
+// Identify the stream of log lines an event belongs to
+func streamKey(le common.LogEvent) string {
+	return le.K8sMetadata.PodID + "/" + le.K8sMetadata.ContainerName + "/" + le.Stream
+}
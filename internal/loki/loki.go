@@ -0,0 +1,321 @@
+// Package loki decodes Loki push API requests, as sent by Promtail, Grafana
+// Alloy and the Docker Loki driver, into log events.
+package loki
+
+import (
+	"encoding/json"
+	"fmt"
+	"log-analyzer/internal/common"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Labels mapped onto the workload metadata of an event, by precedence
+var (
+	namespaceLabels = []string{"namespace", "k8s_namespace_name"}
+	podLabels       = []string{"pod", "k8s_pod_name", "instance"}
+	containerLabels = []string{"container", "k8s_container_name", "container_name", "compose_service", "service_name", "app", "job"}
+	hostLabels      = []string{"node_name", "host", "hostname"}
+	levelLabels     = []string{"level", "detected_level", "severity"}
+)
+
+// A push request with its entries mapped onto log events
+type Push struct {
+	Events   []common.LogEvent
+	Rejected int   // entries that were skipped
+	Err      error // reason of the first rejected entry
+}
+
+func (p *Push) reject(err error) {
+	if p.Err == nil {
+		p.Err = err
+	}
+	p.Rejected++
+}
+
+// Decode a JSON push request:
+//
+//	{"streams": [{"stream": {"label": "value"}, "values": [["<unix ns>", "<line>", {<metadata>}]]}]}
+func DecodeJSON(b []byte) (*Push, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+
+	push := &Push{}
+	for _, st := range req.Streams {
+		le := event(st.Stream)
+		for _, v := range st.Values {
+			if len(v) < 2 {
+				push.reject(fmt.Errorf("entry with %d fields", len(v)))
+				continue
+			}
+			var ts, line string
+			if err := json.Unmarshal(v[0], &ts); err != nil {
+				push.reject(fmt.Errorf("invalid timestamp: %w", err))
+				continue
+			}
+			if err := json.Unmarshal(v[1], &line); err != nil {
+				push.reject(fmt.Errorf("invalid line: %w", err))
+				continue
+			}
+			ns, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				push.reject(fmt.Errorf("invalid timestamp %q", ts))
+				continue
+			}
+			var metadata map[string]string
+			if len(v) > 2 {
+				if err := json.Unmarshal(v[2], &metadata); err != nil {
+					push.reject(fmt.Errorf("invalid structured metadata: %w", err))
+					continue
+				}
+			}
+			push.Events = append(push.Events, entry(le, time.Unix(0, ns), line, metadata))
+		}
+	}
+	return push, nil
+}
+
+// Decode a snappy compressed protobuf push request. Fails with an
+// *http.MaxBytesError if it is larger than maxBytes once decompressed:
+//
+//	PushRequest  { repeated Stream streams = 1; }
+//	Stream       { string labels = 1; repeated Entry entries = 2; }
+//	Entry        { Timestamp timestamp = 1; string line = 2; repeated LabelPair structuredMetadata = 3; }
+//	LabelPair    { string name = 1; string value = 2; }
+func DecodeProto(compressed []byte, maxBytes int64) (*Push, error) {
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && int64(n) > maxBytes {
+		return nil, &http.MaxBytesError{Limit: maxBytes}
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	push := &Push{}
+	err = eachField(b, func(num protowire.Number, v []byte) error {
+		if num == 1 {
+			return push.decodeStream(v)
+		}
+		return nil
+	})
+	return push, err
+}
+
+func (push *Push) decodeStream(b []byte) error {
+	var labels string
+	var entries [][]byte
+	err := eachField(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			labels = string(v)
+		case 2:
+			entries = append(entries, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ls, err := ParseLabels(labels)
+	if err != nil {
+		push.Rejected += len(entries)
+		if push.Err == nil {
+			push.Err = err
+		}
+		return nil
+	}
+	le := event(ls)
+	for _, e := range entries {
+		var ts time.Time
+		var line string
+		metadata := make(map[string]string)
+		err := eachField(e, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				var err error
+				ts, err = decodeTimestamp(v)
+				return err
+			case 2:
+				line = string(v)
+			case 3:
+				var name, value string
+				err := eachField(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case 1:
+						name = string(v)
+					case 2:
+						value = string(v)
+					}
+					return nil
+				})
+				metadata[name] = value
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		push.Events = append(push.Events, entry(le, ts, line, metadata))
+	}
+	return nil
+}
+
+// google.protobuf.Timestamp { int64 seconds = 1; int32 nanos = 2; }
+func decodeTimestamp(b []byte) (time.Time, error) {
+	var sec, nsec int64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.VarintType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return time.Time{}, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			sec = int64(v)
+		case 2:
+			nsec = int64(int32(v))
+		}
+	}
+	return time.Unix(sec, nsec).UTC(), nil
+}
+
+// Call fn with every length-delimited field of a message, skipping all
+// other fields
+func eachField(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build the event template of a stream from its labels. All labels are kept
+// as labels of the workload
+func event(labels map[string]string) common.LogEvent {
+	get := func(keys []string) string {
+		for _, k := range keys {
+			if v := labels[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	meta := common.K8sMetadata{
+		Namespace:     get(namespaceLabels),
+		PodName:       get(podLabels),
+		ContainerName: get(containerLabels),
+		Host:          get(hostLabels),
+		Labels:        make(map[string]interface{}, len(labels)),
+	}
+	if meta.PodName == "" {
+		meta.PodName = meta.Host
+	}
+	meta.PodID = meta.PodName
+	for k, v := range labels {
+		meta.Labels[k] = v
+	}
+
+	return common.LogEvent{
+		Stream:      labels["stream"],
+		Level:       get(levelLabels),
+		K8sMetadata: meta,
+	}
+}
+
+// Stamp a copy of the stream event with the entry. Structured metadata may
+// carry the level and tracing context of the entry
+func entry(le common.LogEvent, ts time.Time, line string, metadata map[string]string) common.LogEvent {
+	le.Time = ts
+	le.Log = line
+	for _, k := range levelLabels {
+		if v := metadata[k]; v != "" {
+			le.Level = v
+			break
+		}
+	}
+	le.TraceID = metadata["trace_id"]
+	le.SpanID = metadata["span_id"]
+	return le
+}
+
+// Parse a label set in the Prometheus text format: {name="value", ...}
+func ParseLabels(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("invalid labels %q", s)
+	}
+	s = s[1 : len(s)-1]
+
+	labels := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return labels, nil
+		}
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid labels, %q has no value", s)
+		}
+		quoted, err := strconv.QuotedPrefix(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of label %q", name)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of label %q", name)
+		}
+		labels[strings.TrimSpace(name)] = value
+		s = strings.TrimSpace(rest)[len(quoted):]
+	}
+}
@@ -0,0 +1,241 @@
+// Package otlp maps OpenTelemetry OTLP/HTTP log export requests onto log
+// events.
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log-analyzer/internal/common"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Resource attributes mapped onto the workload metadata of an event
+const (
+	attrPodName       = "k8s.pod.name"
+	attrPodUID        = "k8s.pod.uid"
+	attrNamespace     = "k8s.namespace.name"
+	attrContainerName = "k8s.container.name"
+	attrNodeName      = "k8s.node.name"
+	attrImageName     = "container.image.name"
+	attrImageTag      = "container.image.tag"
+	attrHostName      = "host.name"
+	attrServiceName   = "service.name"
+)
+
+// Decode an export request in the protobuf encoding
+func DecodeProto(b []byte) (*collogspb.ExportLogsServiceRequest, error) {
+	var req collogspb.ExportLogsServiceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Decode an export request in the JSON encoding. OTLP/JSON writes trace and
+// span ids as hex strings where protojson expects base64
+func DecodeJSON(b []byte) (*collogspb.ExportLogsServiceRequest, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	for _, rl := range objects(raw["resourceLogs"]) {
+		for _, sl := range objects(rl["scopeLogs"]) {
+			for _, lr := range objects(sl["logRecords"]) {
+				for _, key := range []string{"traceId", "spanId"} {
+					if id, ok := lr[key].(string); ok {
+						b, err := hex.DecodeString(id)
+						if err != nil {
+							return nil, fmt.Errorf("invalid %s %q", key, id)
+						}
+						lr[key] = base64.StdEncoding.EncodeToString(b)
+					}
+				}
+			}
+		}
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var req collogspb.ExportLogsServiceRequest
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func objects(v any) []map[string]any {
+	list, _ := v.([]any)
+	objs := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		if obj, ok := item.(map[string]any); ok {
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+// Map the log records of an export request onto log events.
+// Records without a body are rejected, returns the number of them
+func Events(req *collogspb.ExportLogsServiceRequest) ([]common.LogEvent, int) {
+	var events []common.LogEvent
+	rejected := 0
+	for _, rl := range req.GetResourceLogs() {
+		meta := resourceMetadata(rl.GetResource().GetAttributes())
+		for _, sl := range rl.GetScopeLogs() {
+			for _, lr := range sl.GetLogRecords() {
+				le, ok := event(lr, meta)
+				if !ok {
+					rejected++
+					continue
+				}
+				events = append(events, le)
+			}
+		}
+	}
+	return events, rejected
+}
+
+func event(lr *logspb.LogRecord, meta common.K8sMetadata) (common.LogEvent, bool) {
+	body := lr.GetBody()
+	if body == nil || body.Value == nil {
+		return common.LogEvent{}, false
+	}
+
+	le := common.LogEvent{
+		Log:         valueString(body),
+		Level:       level(lr.GetSeverityNumber(), lr.GetSeverityText()),
+		K8sMetadata: meta,
+	}
+	if len(lr.GetTraceId()) > 0 {
+		le.TraceID = hex.EncodeToString(lr.GetTraceId())
+	}
+	if len(lr.GetSpanId()) > 0 {
+		le.SpanID = hex.EncodeToString(lr.GetSpanId())
+	}
+
+	ts := lr.GetTimeUnixNano()
+	if ts == 0 {
+		ts = lr.GetObservedTimeUnixNano()
+	}
+	if ts > 0 {
+		le.Time = time.Unix(0, int64(ts)).UTC()
+	}
+	return le, true
+}
+
+// Map resource attributes onto workload metadata. A resource without
+// Kubernetes attributes is identified by its host and service.
+// All attributes are kept as labels
+func resourceMetadata(attrs []*commonpb.KeyValue) common.K8sMetadata {
+	meta := common.K8sMetadata{Labels: make(map[string]interface{}, len(attrs))}
+	for _, kv := range attrs {
+		meta.Labels[kv.GetKey()] = valueString(kv.GetValue())
+	}
+	get := func(key string) string {
+		s, _ := meta.Labels[key].(string)
+		return s
+	}
+
+	meta.PodName = get(attrPodName)
+	meta.PodID = get(attrPodUID)
+	meta.Namespace = get(attrNamespace)
+	meta.ContainerName = get(attrContainerName)
+	meta.Host = get(attrNodeName)
+	meta.ContainerImg = get(attrImageName)
+	if tag := get(attrImageTag); meta.ContainerImg != "" && tag != "" {
+		meta.ContainerImg += ":" + tag
+	}
+
+	if meta.Host == "" {
+		meta.Host = get(attrHostName)
+	}
+	if meta.PodName == "" {
+		meta.PodName = meta.Host
+	}
+	if meta.PodID == "" {
+		meta.PodID = meta.PodName
+	}
+	if meta.ContainerName == "" {
+		meta.ContainerName = get(attrServiceName)
+	}
+	return meta
+}
+
+// Severity number ranges of the OpenTelemetry log data model, falling back
+// to the severity text for records without a number
+func level(num logspb.SeverityNumber, text string) string {
+	switch {
+	case num >= logspb.SeverityNumber_SEVERITY_NUMBER_FATAL:
+		return common.LevelFatal
+	case num >= logspb.SeverityNumber_SEVERITY_NUMBER_ERROR:
+		return common.LevelError
+	case num >= logspb.SeverityNumber_SEVERITY_NUMBER_WARN:
+		return common.LevelWarn
+	case num >= logspb.SeverityNumber_SEVERITY_NUMBER_INFO:
+		return common.LevelInfo
+	case num >= logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG:
+		return common.LevelDebug
+	case num >= logspb.SeverityNumber_SEVERITY_NUMBER_TRACE:
+		return common.LevelTrace
+	default:
+		return common.NormalizeLevel(text)
+	}
+}
+
+// Render a value as a log line. Maps and arrays are rendered as JSON, so the
+// message field of structured bodies is picked up by the parser
+func valueString(v *commonpb.AnyValue) string {
+	switch v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.GetStringValue()
+	case *commonpb.AnyValue_KvlistValue, *commonpb.AnyValue_ArrayValue:
+		b, err := json.Marshal(value(v))
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(value(v))
+	}
+}
+
+func value(v *commonpb.AnyValue) any {
+	switch v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.GetStringValue()
+	case *commonpb.AnyValue_BoolValue:
+		return v.GetBoolValue()
+	case *commonpb.AnyValue_IntValue:
+		return v.GetIntValue()
+	case *commonpb.AnyValue_DoubleValue:
+		return v.GetDoubleValue()
+	case *commonpb.AnyValue_BytesValue:
+		return hex.EncodeToString(v.GetBytesValue())
+	case *commonpb.AnyValue_ArrayValue:
+		values := v.GetArrayValue().GetValues()
+		list := make([]any, len(values))
+		for i, item := range values {
+			list[i] = value(item)
+		}
+		return list
+	case *commonpb.AnyValue_KvlistValue:
+		kvs := v.GetKvlistValue().GetValues()
+		obj := make(map[string]any, len(kvs))
+		for _, kv := range kvs {
+			obj[kv.GetKey()] = value(kv.GetValue())
+		}
+		return obj
+	default:
+		return ""
+	}
+}
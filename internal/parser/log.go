@@ -3,8 +3,11 @@ package parser
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"strings"
+	"sync"
+	"time"
 
 	common "log-analyzer/internal/common"
 	db "log-analyzer/internal/db"
@@ -12,9 +15,31 @@ import (
 
 var logFieldAlias = []string{"message", "msg", "log"}
 
-func NewLogParser(tdb *db.TemplateDB) (*LogParser, error) {
+type Options struct {
+	// Min share of matching tokens for a log to join an existing template,
+	// 0 selects common.DefaultSimilarity
+	Similarity float64
+	// Max differing tokens for near-identical templates to be merged into
+	// one wildcard template, 0 disables merging
+	MergeDistance int
+	// Masking rules, nil selects DefaultRules
+	Rules *Rules
+	// Workloads sharing a scope key share templates
+	Scope common.TemplateScope
+}
+
+func NewLogParser(tdb db.Store, opts Options) (*LogParser, error) {
 	lp := &LogParser{}
 	lp.tdb = tdb
+	lp.rules = opts.Rules
+	if lp.rules == nil {
+		lp.rules = DefaultRules()
+	}
+	lp.scope = opts.Scope
+	lp.treeOpts = common.TreeOptions{
+		Similarity:    opts.Similarity,
+		MergeDistance: opts.MergeDistance,
+	}
 
 	// Fetch template tree from DB
 	lp.LoadTemplates()
@@ -22,32 +47,71 @@ func NewLogParser(tdb *db.TemplateDB) (*LogParser, error) {
 	return lp, nil
 }
 
+// LogParser is safe for concurrent use
 type LogParser struct {
-	tt  common.TemplateTree
-	tdb *db.TemplateDB
+	trees    sync.Map // scope key to *common.TemplateTree
+	treeOpts common.TreeOptions
+	scope    common.TemplateScope
+	tdb      db.Store
+	rules    *Rules
+}
+
+// Return the template tree of a scope, creating it on first use
+func (lp *LogParser) tree(scope string) *common.TemplateTree {
+	if tt, ok := lp.trees.Load(scope); ok {
+		return tt.(*common.TemplateTree)
+	}
+	tt, _ := lp.trees.LoadOrStore(scope, common.NewTemplateTree(nil, lp.treeOpts))
+	return tt.(*common.TemplateTree)
 }
 
 // Try to parse incoming log as a JSON string
-// Returns template of the parsed log and if a new template is created
-func (lp *LogParser) ParseLog(s string) (tmpl common.Template, newTmpl bool) {
+// Returns template of the parsed log stamped with the event time ts and the
+// workload metadata of the event, and if a new template is created
+func (lp *LogParser) ParseLog(s string, ts time.Time, meta common.K8sMetadata) (tmpl common.Template, newTmpl bool) {
 	rawLog, err := parseJsonLog(s)
 	if err != nil {
 		rawLog = string(s)
 	}
 
-	log := preNormalize(rawLog)
+	rules := lp.rules.For(meta)
+	log := preNormalize(rawLog, rules.Pre)
 	tokens := tokenize(log)
 	for i, token := range tokens {
-		tokens[i] = postNormalize(token)
+		tokens[i] = postNormalize(token, rules.Post)
 	}
 
 	// Create new template if no template found
-	tmpl, ok := lp.tt.Find(tokens)
-	if !ok {
-		tmpl = lp.tt.Save(tokens)
-		lp.tdb.SaveTemplate(tmpl)
+	scope := lp.scope.Key(meta)
+	m := lp.tree(scope).Match(tokens)
+	tmpl = m.Template
+	tmpl.Scope = scope
+	switch {
+	case m.Created:
+		if err := lp.tdb.SaveTemplate(tmpl); err != nil {
+			slog.Error(fmt.Sprintf("Failed to save template %s: %s", tmpl.ID, err))
+		}
+	case len(m.Merged) > 0:
+		lp.mergeTemplates(common.Merge{Survivor: tmpl, Merged: m.Merged})
+	case m.Updated:
+		slog.Debug(fmt.Sprintf("Template generalized: %s", tmpl.ID))
+		if err := lp.tdb.UpdateTemplate(tmpl); err != nil {
+			slog.Error(fmt.Sprintf("Failed to update template %s: %s", tmpl.ID, err))
+		}
+	}
+	tmpl.Timestamp = ts
+	tmpl.K8sMetadata = meta
+	tmpl.Sample = rawLog
+	tmpl.Level = extractLevel(rawLog)
+	return tmpl, m.Created
+}
+
+// Fold the stats of merged templates into the survivor and record lineage
+func (lp *LogParser) mergeTemplates(m common.Merge) {
+	slog.Info(fmt.Sprintf("Merging templates %s into %s: %s", strings.Join(m.Merged, ", "), m.Survivor.ID, strings.Join(m.Survivor.Tokens, " ")))
+	if err := lp.tdb.MergeTemplates(m.Survivor, m.Merged); err != nil {
+		slog.Error(fmt.Sprintf("Failed to merge templates into %s: %s", m.Survivor.ID, err))
 	}
-	return tmpl, !ok
 }
 
 // Try to parse a string as a json string and return the raw log line
@@ -58,22 +122,41 @@ func parseJsonLog(s string) (string, error) {
 		return "", err
 	}
 
+	if m, ok := LogMessage(jsonLog); ok {
+		return m, nil
+	}
+	return "", errors.New("no log field found in JSON")
+}
+
+// Return the log line of a structured log record, the first of its
+// logFieldAlias fields holding a string
+func LogMessage(fields map[string]interface{}) (string, bool) {
 	for _, alias := range logFieldAlias {
-		m, ok := jsonLog[alias].(string)
+		m, ok := fields[alias].(string)
 		if ok {
-			return m, nil
+			return m, true
 		}
 	}
-	return "", errors.New("no log field found in JSON")
+	return "", false
 }
 
-func preNormalize(s string) string {
-	for _, rule := range preTokenizeRules {
+func preNormalize(s string, rules []MaskRule) string {
+	for _, rule := range rules {
 		s = rule.Pattern.ReplaceAllString(s, rule.Token)
 	}
 	return s
 }
 
+// Return the canonical log level of the raw log line before it is masked as
+// <LEVEL>, or an empty string if the line has none
+func extractLevel(s string) string {
+	m := levelPattern.FindStringSubmatch(s)
+	if m == nil {
+		return ""
+	}
+	return common.NormalizeLevel(m[1])
+}
+
 // Split the given string by spaces, linebreaks, or punctuation marks
 func tokenize(s string) []string {
 	fields := strings.FieldsFunc(s, func(r rune) bool {
@@ -83,8 +166,8 @@ func tokenize(s string) []string {
 }
 
 // Replace common values with tokens
-func postNormalize(s string) string {
-	for _, rule := range postTokenizeRules {
+func postNormalize(s string, rules []MaskRule) string {
+	for _, rule := range rules {
 		s = rule.Pattern.ReplaceAllString(s, rule.Token)
 	}
 	return s
@@ -101,6 +184,30 @@ func (lp *LogParser) LoadTemplates() error {
 	}
 
 	slog.Debug("Successfully loaded template tree from DB")
-	lp.tt = templates
+
+	// Split templates into their scopes, keeping the oldest first order
+	scoped := make(map[string]map[int][]common.Template)
+	orders := make(map[string][]string)
+	for count, bucket := range templates {
+		for _, t := range bucket {
+			if scoped[t.Scope] == nil {
+				scoped[t.Scope] = make(map[int][]common.Template)
+			}
+			scoped[t.Scope][count] = append(scoped[t.Scope][count], t)
+			orders[t.Scope] = append(orders[t.Scope], t.ID)
+		}
+	}
+
+	lp.trees.Clear()
+	for scope, st := range scoped {
+		tt := lp.tree(scope)
+		tt.Load(st)
+
+		// Merge near-identical templates stored before
+		for _, m := range tt.Compact(orders[scope]) {
+			m.Survivor.Scope = scope
+			lp.mergeTemplates(m)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	common "log-analyzer/internal/common"
+	db "log-analyzer/internal/db"
+)
+
+// Run with -race: concurrent parsing of the same patterns must settle on
+// one template per pattern
+func TestParseLogConcurrent(t *testing.T) {
+	patterns := []string{
+		"user %d logged in from 10.0.%d.1",
+		"GET /api/orders/%d returned 200 in %dms",
+		"cache miss for key session-%d after %d attempts",
+		"worker %d finished batch %d",
+		"connection reset by peer while reading request body of length %d bytes from upstream %d",
+	}
+
+	lp, err := NewLogParser(db.NewMemoryStore(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines = 16
+	const lines = 25
+
+	ids := make([][]map[string]bool, goroutines)
+	ts := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		ids[g] = make([]map[string]bool, len(patterns))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				for p, pattern := range patterns {
+					if ids[g][p] == nil {
+						ids[g][p] = make(map[string]bool)
+					}
+					tmpl, _ := lp.ParseLog(fmt.Sprintf(pattern, g*lines+i, i), ts, common.K8sMetadata{})
+					ids[g][p][tmpl.ID] = true
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for p, pattern := range patterns {
+		seen := make(map[string]bool)
+		for g := range goroutines {
+			for id := range ids[g][p] {
+				seen[id] = true
+			}
+		}
+		if len(seen) != 1 {
+			t.Errorf("pattern %q got %d templates, want 1", pattern, len(seen))
+		}
+	}
+
+	templates, err := lp.tdb.GetAllTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	for _, bucket := range templates {
+		stored += len(bucket)
+	}
+	if stored != len(patterns) {
+		t.Errorf("got %d stored templates, want %d", stored, len(patterns))
+	}
+}
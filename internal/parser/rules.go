@@ -41,3 +41,6 @@ var postTokenizeRules = []MaskRule{
 	// 8. Numbers
 	{regexp.MustCompile(`\d+(?:\.\d+)?`), "<NUM>"},
 }
+
+// Log level keyword, used to recover the level masked by preTokenizeRules
+var levelPattern = regexp.MustCompile(`(?i)\b(trace|debug|info|warn(?:ing)?|error|err|fatal|critical|panic)\b`)
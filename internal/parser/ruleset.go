@@ -0,0 +1,231 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	common "log-analyzer/internal/common"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	stagePre  = "pre"  // applied to the whole line before tokenizing
+	stagePost = "post" // applied to each token
+
+	// Order of the built-in rules, custom rules run before them by default
+	builtinOrder = 100
+)
+
+// Masking rules file, YAML or JSON.
+//
+//	defaults: true            # keep the built-in rules, default true
+//	rules:                    # applied to every log
+//	  - name: order-number
+//	    stage: post           # pre (whole line) or post (each token), default pre
+//	    pattern: 'ORD-\d+'
+//	    token: <ORDER>
+//	    order: 0              # lower runs first, built-in rules run at 100
+//	scopes:                   # applied to logs of matching workloads only
+//	  - namespace: payments   # namespace and/or container
+//	    container: api
+//	    rules: [...]
+type rulesFile struct {
+	Defaults *bool         `yaml:"defaults"`
+	Rules    []ruleConfig  `yaml:"rules"`
+	Scopes   []scopeConfig `yaml:"scopes"`
+}
+
+type ruleConfig struct {
+	Name    string `yaml:"name"`
+	Stage   string `yaml:"stage"`
+	Pattern string `yaml:"pattern"`
+	Token   string `yaml:"token"`
+	Order   int    `yaml:"order"`
+}
+
+type scopeConfig struct {
+	Namespace string       `yaml:"namespace"`
+	Container string       `yaml:"container"`
+	Rules     []ruleConfig `yaml:"rules"`
+}
+
+var tokenPattern = regexp.MustCompile(`^<[A-Za-z0-9_*-]+>$`)
+
+// Masking rules in the order they are applied
+type RuleSet struct {
+	Pre  []MaskRule
+	Post []MaskRule
+}
+
+// Rules resolves the masking rules of a workload.
+// It is safe for concurrent use.
+type Rules struct {
+	global []orderedRule
+	scopes []scopedRules
+
+	cache sync.Map // workload key to RuleSet
+}
+
+type orderedRule struct {
+	MaskRule
+	stage string
+	order int
+}
+
+type scopedRules struct {
+	namespace string
+	container string
+	rules     []orderedRule
+}
+
+// The built-in masking rules
+func DefaultRules() *Rules {
+	return &Rules{global: builtinRules()}
+}
+
+func builtinRules() []orderedRule {
+	var rules []orderedRule
+	for _, r := range preTokenizeRules {
+		rules = append(rules, orderedRule{MaskRule: r, stage: stagePre, order: builtinOrder})
+	}
+	for _, r := range postTokenizeRules {
+		rules = append(rules, orderedRule{MaskRule: r, stage: stagePost, order: builtinOrder})
+	}
+	return rules
+}
+
+// Load and validate masking rules from a YAML or JSON file
+func LoadRules(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("rules file %s: %s", path, err)
+	}
+	defer f.Close()
+
+	var rf rulesFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&rf); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("rules file %s: %s", path, err)
+	}
+
+	rules := &Rules{}
+	var errs []error
+
+	// Custom rules come first so they win ties in order over built-in ones
+	rules.global, errs = compileRules("rules", rf.Rules, errs)
+	if rf.Defaults == nil || *rf.Defaults {
+		rules.global = append(rules.global, builtinRules()...)
+	}
+
+	for i, sc := range rf.Scopes {
+		field := fmt.Sprintf("scopes[%d]", i)
+		if sc.Namespace == "" && sc.Container == "" {
+			errs = append(errs, fmt.Errorf("%s: namespace or container is required", field))
+		}
+		if len(sc.Rules) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no rules", field))
+		}
+
+		var compiled []orderedRule
+		compiled, errs = compileRules(field+".rules", sc.Rules, errs)
+		rules.scopes = append(rules.scopes, scopedRules{
+			namespace: sc.Namespace,
+			container: sc.Container,
+			rules:     compiled,
+		})
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("rules file %s: %w", path, errors.Join(errs...))
+	}
+	return rules, nil
+}
+
+func compileRules(field string, rcs []ruleConfig, errs []error) ([]orderedRule, []error) {
+	var rules []orderedRule
+	for i, rc := range rcs {
+		name := fmt.Sprintf("%s[%d]", field, i)
+		if rc.Name != "" {
+			name = fmt.Sprintf("%s (%s)", name, rc.Name)
+		}
+
+		stage := strings.ToLower(rc.Stage)
+		if stage == "" {
+			stage = stagePre
+		}
+		if stage != stagePre && stage != stagePost {
+			errs = append(errs, fmt.Errorf("%s: unknown stage %q (expected pre or post)", name, rc.Stage))
+			continue
+		}
+
+		// Tokens must look like the built-in ones to be treated as wildcards
+		if !tokenPattern.MatchString(rc.Token) {
+			errs = append(errs, fmt.Errorf("%s: token %q must look like <NAME>", name, rc.Token))
+			continue
+		}
+
+		if rc.Pattern == "" {
+			errs = append(errs, fmt.Errorf("%s: pattern is required", name))
+			continue
+		}
+		pattern, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid pattern: %s", name, err))
+			continue
+		}
+		if pattern.MatchString("") {
+			errs = append(errs, fmt.Errorf("%s: pattern %q matches the empty string", name, rc.Pattern))
+			continue
+		}
+
+		rules = append(rules, orderedRule{
+			MaskRule: MaskRule{Pattern: pattern, Token: rc.Token},
+			stage:    stage,
+			order:    rc.Order,
+		})
+	}
+	return rules, errs
+}
+
+// Return the rules applying to logs of the workload
+func (r *Rules) For(meta common.K8sMetadata) RuleSet {
+	key := meta.Namespace + "/" + meta.ContainerName
+	if rs, ok := r.cache.Load(key); ok {
+		return rs.(RuleSet)
+	}
+
+	// Scoped rules come first so they win ties in order over global ones
+	var all []orderedRule
+	for _, sc := range r.scopes {
+		if sc.matches(meta) {
+			all = append(all, sc.rules...)
+		}
+	}
+	all = append(all, r.global...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].order < all[j].order })
+
+	var rs RuleSet
+	for _, rule := range all {
+		if rule.stage == stagePre {
+			rs.Pre = append(rs.Pre, rule.MaskRule)
+		} else {
+			rs.Post = append(rs.Post, rule.MaskRule)
+		}
+	}
+
+	r.cache.Store(key, rs)
+	return rs
+}
+
+func (sc scopedRules) matches(meta common.K8sMetadata) bool {
+	return (sc.namespace == "" || sc.namespace == meta.Namespace) &&
+		(sc.container == "" || sc.container == meta.ContainerName)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"log-analyzer/internal/anomaly"
+	"log-analyzer/internal/common"
+	"time"
+)
+
+type Config struct {
+	// SQLite template DB, empty to keep templates and counters in memory only
+	DatabaseFile string
+
+	// Offline runs process a finite batch of events and don't start the
+	// alert flush or detector sweep schedulers
+	Offline bool
+
+	// YAML or JSON file with custom masking rules, empty for the built-in rules
+	RulesFile string
+
+	// Workloads sharing a scope key share templates, stats and anomalies
+	TemplateScope common.TemplateScope
+
+	// Min share of matching tokens for a log to join an existing template
+	TemplateSimilarity float64
+	// Max differing tokens for near-identical templates to be merged
+	TemplateMergeDistance int
+
+	// Max size of a request body once decompressed, or of a Forward message
+	// as sent and once its entries are decompressed, 0 for no limit
+	MaxBodyBytes int64
+
+	// Template counters are kept in memory and written to the DB this often,
+	// a crash loses the counts of up to this long
+	StatsFlushInterval time.Duration
+
+	// Retention of the counters in the DB and DB file maintenance
+	CompactInterval      time.Duration // roll up old hourly counts and fold gone pods this often
+	DailyCountsRetention time.Duration // keep daily aggregates this long, 0 forever
+	GonePodRetention     time.Duration // fold the transitions of pods unseen this long into their workload
+	CheckpointInterval   time.Duration // checkpoint the WAL this often, 0 to disable
+	VacuumInterval       time.Duration // VACUUM the DB this often, 0 to disable
+
+	// Deadline of draining ingest, flushing alerts and closing the DB on shutdown
+	ShutdownTimeout time.Duration
+
+	// Ingest queue between the receivers and the parser
+	QueueSize    int // max events waiting to be processed
+	QueueWorkers int
+
+	// Fluent Forward listen address, empty to disable
+	ForwardAddr string
+
+	// Syslog listen addresses, empty to disable
+	SyslogUDPAddr string
+	SyslogTCPAddr string
+	SyslogTLSAddr string
+	SyslogTLSCert string // PEM certificate and key files for the TLS listener
+	SyslogTLSKey  string
+	// Zone of RFC 3164 timestamps, which carry none
+	SyslogLocation *time.Location
+
+	// CRI partial line reassembly
+	PartialTimeout  time.Duration // release a partial line without its final record after this long
+	PartialMaxBytes int           // cut reassembled lines at this size
+
+	// Stack trace grouping
+	MultilineTimeout  time.Duration // release a trace after this long without a new line
+	MultilineMaxLines int           // release a trace once it reaches this many lines
+
+	// Late and out-of-order event handling
+	LatePolicy   common.LatePolicy
+	MaxLateness  time.Duration // events this far behind the watermark are late
+	MaxClockSkew time.Duration // events this far ahead of the wall-clock are clamped
+
+	// New template detection
+	NewTemplateGracePeriod   time.Duration // quiet period after startup or a new deployment
+	NewTemplateSeverity      anomaly.Severity
+	NewTemplateErrorSeverity anomaly.Severity // for templates with an error or fatal level
+	NewTemplateResolveAfter  time.Duration    // resolve new template alerts after this long
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DatabaseFile: "data.db",
+
+		TemplateSimilarity:    common.DefaultSimilarity,
+		TemplateMergeDistance: common.DefaultMergeDistance,
+
+		MaxBodyBytes: 64 * 1024 * 1024,
+		ForwardAddr:  ":24224",
+
+		SyslogLocation: time.Local,
+
+		StatsFlushInterval: time.Second,
+
+		CompactInterval:      time.Hour,
+		DailyCountsRetention: 90 * 24 * time.Hour,
+		GonePodRetention:     7 * 24 * time.Hour,
+		CheckpointInterval:   10 * time.Minute,
+		VacuumInterval:       7 * 24 * time.Hour,
+
+		ShutdownTimeout: 25 * time.Second, // within the default 30s grace period of Kubernetes
+
+		QueueSize:    10000,
+		QueueWorkers: 4,
+
+		PartialTimeout:  5 * time.Second,
+		PartialMaxBytes: 1024 * 1024,
+
+		MultilineTimeout:  2 * time.Second,
+		MultilineMaxLines: 500,
+
+		LatePolicy:   common.LatePolicyAccept,
+		MaxLateness:  time.Hour,
+		MaxClockSkew: 5 * time.Minute,
+
+		NewTemplateGracePeriod:   10 * time.Minute,
+		NewTemplateSeverity:      anomaly.SeverityMedium,
+		NewTemplateErrorSeverity: anomaly.SeverityHigh,
+		NewTemplateResolveAfter:  time.Hour,
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content-Encoding the server can't decode
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q (expected gzip, deflate or zstd)", e.Encoding)
+}
+
+// Returns the request body, decompressed according to its Content-Encoding
+// and cut at maxBytes once decompressed. Reading past maxBytes fails with an
+// *http.MaxBytesError. The returned function releases the decoders
+func requestBody(w http.ResponseWriter, req *http.Request, maxBytes int64) (io.Reader, func(), error) {
+	var r io.Reader = req.Body
+	var closers []io.Closer
+	release := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	// Encodings are listed in the order they were applied
+	encodings := strings.Split(req.Header.Get("Content-Encoding"), ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[i])); enc {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				release()
+				return nil, nil, fmt.Errorf("invalid gzip payload: %w", err)
+			}
+			closers = append(closers, zr)
+			r = zr
+		case "deflate":
+			r = newDeflateReader(r)
+			closers = append(closers, r.(io.Closer))
+		case "zstd":
+			opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+			if maxBytes > 0 {
+				opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxBytes)))
+			}
+			zr, err := zstd.NewReader(r, opts...)
+			if err != nil {
+				release()
+				return nil, nil, fmt.Errorf("invalid zstd payload: %w", err)
+			}
+			closers = append(closers, zr.IOReadCloser())
+			r = zr
+		default:
+			release()
+			return nil, nil, &UnsupportedEncodingError{Encoding: enc}
+		}
+	}
+
+	if maxBytes > 0 {
+		r = http.MaxBytesReader(w, io.NopCloser(r), maxBytes)
+	}
+	return r, release, nil
+}
+
+// HTTP deflate is meant to be zlib wrapped, but plenty of clients send raw
+// deflate streams. Tell them apart by the zlib header
+func newDeflateReader(r io.Reader) io.ReadCloser {
+	br := bufio.NewReader(r)
+	if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+		zr, err := zlib.NewReader(br)
+		if err == nil {
+			return zr
+		}
+		return io.NopCloser(errReader{err})
+	}
+	return flate.NewReader(br)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// HTTP status for a request body that failed to decode
+func bodyErrorStatus(err error) int {
+	var unsupported *UnsupportedEncodingError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &unsupported):
+		return http.StatusUnsupportedMediaType
+	case errors.As(err, &tooLarge), errors.Is(err, zstd.ErrDecoderSizeExceeded):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -1,38 +1,398 @@
 package server
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log-analyzer/internal/common"
+	"log-analyzer/internal/elastic"
+	"log-analyzer/internal/ingest"
+	"log-analyzer/internal/loki"
+	"log-analyzer/internal/otlp"
 	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	retryAfterSeconds = 5    // suggested to clients turned away by a full queue
+	ingestChunkSize   = 1000 // most events of an ingest request queued at once
 )
 
+// Outcome of an ingest request. A request cut short by a malformed or too
+// large body, or by the ingest queue closing, still ingests the events before
+// that point. It is answered with 207 and the client resumes after the first
+// Accepted+Rejected events
+type IngestResponse struct {
+	Accepted int    `json:"accepted"`
+	Rejected int    `json:"rejected"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Accepts a JSON array of log events, or newline-delimited JSON events,
+// optionally gzip, deflate or zstd compressed.
+// Events are decoded as the body is read and queued in chunks, events that
+// don't decode are counted and skipped. The request is turned away if the
+// queue has no room for the first chunk, the next ones wait for room
 func (s *Server) Ingest(w http.ResponseWriter, req *http.Request) {
-	bodyBytes, err := io.ReadAll(req.Body)
+	body, release, err := requestBody(w, req, s.maxBodyBytes)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		writeJSON(w, bodyErrorStatus(err), IngestResponse{Error: err.Error()})
+		return
+	}
+	defer release()
+	br := bufio.NewReader(body)
+
+	var format string
+	switch mediaType(req.Header.Get("Content-Type")) {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		format = ingest.FormatNDJSON
+	default:
+		format = ingest.DetectJSONFormat(br)
+	}
+
+	cq := s.chunkQueue()
+	chunk := make([]common.LogEvent, 0, cq.size)
+	chunkPos := 0
+	var queueErr error
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := cq.submit(chunk); err != nil {
+			queueErr = err
+			return err
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+	collect := func(le common.LogEvent, pos int) error {
+		if len(chunk) == 0 {
+			chunkPos = pos
+		}
+		chunk = append(chunk, le)
+		if len(chunk) < cq.size {
+			return nil
+		}
+		return flush()
+	}
+
+	var resp IngestResponse
+	if format == ingest.FormatJSON {
+		resp.Accepted, resp.Rejected, err = ingest.DecodeJSONArray(br, collect)
+	} else {
+		resp.Accepted, resp.Rejected, err = ingest.DecodeNDJSON(br, collect)
+	}
+	if queueErr == nil {
+		flush()
+	}
+
+	if queueErr != nil {
+		if cq.queued == 0 {
+			writeJSON(w, queueErrorStatus(w, queueErr), IngestResponse{Error: queueErr.Error()})
+			return
+		}
+		// Resume from the chunk that wasn't queued
+		writeJSON(w, http.StatusMultiStatus, IngestResponse{
+			Accepted: cq.queued,
+			Rejected: chunkPos - cq.queued,
+			Error:    queueErr.Error(),
+		})
 		return
 	}
 
-	var logs []common.LogEvent
-	err = json.Unmarshal(bodyBytes, &logs)
+	status := http.StatusOK
 	if err != nil {
-		errString := fmt.Sprintf("Unable to parse log as a JSON string: %s", err)
-		http.Error(w, errString, http.StatusBadRequest)
+		resp.Error = fmt.Sprintf("Unable to parse logs: %s", err)
+		if resp.Accepted+resp.Rejected == 0 {
+			writeJSON(w, bodyErrorStatus(err), resp)
+			return
+		}
+		// Retrying the whole body would ingest the events before the
+		// error twice
+		status = http.StatusMultiStatus
+	}
+	writeJSON(w, status, resp)
+}
+
+// Queues the events of a request in chunks that always fit in the queue once
+// it drains, so a request may carry more events than a queue shard holds.
+// The request is turned away if the queue has no room for the first chunk,
+// the next ones wait for room
+type chunkQueue struct {
+	s      *Server
+	size   int
+	queued int // events of the request queued so far
+}
+
+func (s *Server) chunkQueue() *chunkQueue {
+	return &chunkQueue{s: s, size: min(ingestChunkSize, s.queue.MaxBatch())}
+}
+
+// Queue events chunk by chunk, up to the first chunk that isn't queued
+func (cq *chunkQueue) submit(events []common.LogEvent) error {
+	for len(events) > 0 {
+		chunk := events[:min(cq.size, len(events))]
+		submit := cq.s.queue.EnqueueAll
+		if cq.queued == 0 {
+			submit = cq.s.Submit
+		}
+		if err := submit(chunk); err != nil {
+			return err
+		}
+		cq.queued += len(chunk)
+		events = events[len(chunk):]
+	}
+	return nil
+}
+
+// HTTP status for events the ingest queue turned away, along with when to
+// retry
+func queueErrorStatus(w http.ResponseWriter, err error) int {
+	if errors.Is(err, ingest.ErrBatchTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	if errors.Is(err, ingest.ErrQueueFull) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to write response: %s", err))
+	}
+}
+
+// OTLP/HTTP logs export, protobuf or JSON encoded. Records without a body
+// are rejected and reported as a partial success, as are the records left
+// over if the queue closes part way through the export
+func (s *Server) OTLPLogs(w http.ResponseWriter, req *http.Request) {
+	isJSON := false
+	switch mediaType(req.Header.Get("Content-Type")) {
+	case "application/x-protobuf", "application/protobuf":
+	case "application/json":
+		isJSON = true
+	default:
+		writeOTLPStatus(w, http.StatusUnsupportedMediaType, isJSON, "unsupported content type, expected application/x-protobuf or application/json")
 		return
 	}
 
-	for _, le := range logs {
-		tmpl, newTemplate := s.lp.ParseLog(le.Log)
-		if newTemplate {
-			slog.Debug(fmt.Sprintf("New template detected: %s", tmpl.ID))
-			// TODO mark AnomalyTypeNewTemplate as pending to be sent out
-			// TODO send alert for new Template
+	body, release, err := requestBody(w, req, s.maxBodyBytes)
+	if err != nil {
+		writeOTLPStatus(w, bodyErrorStatus(err), isJSON, err.Error())
+		return
+	}
+	defer release()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		writeOTLPStatus(w, bodyErrorStatus(err), isJSON, err.Error())
+		return
+	}
+
+	decode := otlp.DecodeProto
+	if isJSON {
+		decode = otlp.DecodeJSON
+	}
+	export, err := decode(b)
+	if err != nil {
+		writeOTLPStatus(w, http.StatusBadRequest, isJSON, fmt.Sprintf("Unable to parse logs: %s", err))
+		return
+	}
+
+	events, rejected := otlp.Events(export)
+	msg := fmt.Sprintf("%d log records without a body", rejected)
+	cq := s.chunkQueue()
+	if err := cq.submit(events); err != nil {
+		if cq.queued == 0 {
+			writeOTLPStatus(w, queueErrorStatus(w, err), isJSON, err.Error())
+			return
+		}
+		rejected += len(events) - cq.queued
+		msg = fmt.Sprintf("%d log records without a body or not queued: %s", rejected, err)
+	}
+
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if rejected > 0 {
+		resp.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+			RejectedLogRecords: int64(rejected),
+			ErrorMessage:       msg,
+		}
+	}
+	writeOTLP(w, http.StatusOK, isJSON, resp)
+}
+
+func writeOTLP(w http.ResponseWriter, status int, isJSON bool, m proto.Message) {
+	var b []byte
+	var err error
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		b, err = protojson.Marshal(m)
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		b, err = proto.Marshal(m)
+	}
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to encode response: %s", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// Failures are reported as a google.rpc.Status
+func writeOTLPStatus(w http.ResponseWriter, status int, isJSON bool, msg string) {
+	code := codes.InvalidArgument
+	if status >= http.StatusInternalServerError {
+		code = codes.Internal
+	}
+	writeOTLP(w, status, isJSON, &spb.Status{Code: int32(code), Message: msg})
+}
+
+// Loki push API, JSON or snappy compressed protobuf. Responds like Loki does,
+// so agents can tee their traffic here unchanged. Loki has no partial
+// success, a push cut short by the queue closing is retried as a whole
+func (s *Server) LokiPush(w http.ResponseWriter, req *http.Request) {
+	body, release, err := requestBody(w, req, s.maxBodyBytes)
+	if err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+	defer release()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+
+	var push *loki.Push
+	if mediaType(req.Header.Get("Content-Type")) == "application/json" {
+		push, err = loki.DecodeJSON(b)
+	} else {
+		push, err = loki.DecodeProto(b, s.maxBodyBytes)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to parse logs: %s", err), bodyErrorStatus(err))
+		return
+	}
+
+	if err := s.chunkQueue().submit(push.Events); err != nil {
+		http.Error(w, err.Error(), queueErrorStatus(w, err))
+		return
+	}
+
+	if push.Rejected > 0 {
+		http.Error(w, fmt.Sprintf("%d entries rejected: %s", push.Rejected, push.Err), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Elasticsearch bulk API, for the index given in the path or in the action
+// lines. Items fail with a non-retryable status if their document has no log
+// line, and with a retryable one if the queue closes before they are queued
+func (s *Server) ElasticBulk(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	body, release, err := requestBody(w, req, s.maxBodyBytes)
+	if err != nil {
+		writeElasticError(w, bodyErrorStatus(err), err)
+		return
+	}
+	defer release()
+
+	var events []common.LogEvent
+	resp, err := elastic.ReadBulk(body, req.PathValue("index"), func(le common.LogEvent) {
+		events = append(events, le)
+	})
+	if err != nil {
+		writeElasticError(w, bodyErrorStatus(err), err)
+		return
+	}
+	cq := s.chunkQueue()
+	if err := cq.submit(events); err != nil {
+		status := queueErrorStatus(w, err)
+		if cq.queued == 0 {
+			writeElasticError(w, status, err)
+			return
+		}
+		rejectUnqueued(resp, cq.queued, status, err)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Fail the items of the events after the first queued ones, items of events
+// being the ones that succeeded
+func rejectUnqueued(resp *elastic.BulkResponse, queued int, status int, err error) {
+	for _, action := range resp.Items {
+		for _, item := range action {
+			if item.Error != nil || item.Status == http.StatusNotFound {
+				continue
+			}
+			if queued > 0 {
+				queued--
+				continue
+			}
+			*item = elastic.BulkItem{
+				Index:  item.Index,
+				ID:     item.ID,
+				Status: status,
+				Error:  &elastic.ItemError{Type: elasticErrorType(status), Reason: err.Error()},
+			}
+			resp.Errors = true
 		}
+	}
+}
+
+// Cluster info probed by Elasticsearch clients before they ship
+func (s *Server) ElasticInfo(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"name":         "log-analyzer",
+		"cluster_name": "log-analyzer",
+		"version": map[string]string{
+			"number":                              elastic.Version,
+			"build_flavor":                        "default",
+			"minimum_wire_compatibility_version":  "7.17.0",
+			"minimum_index_compatibility_version": "7.0.0",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+func writeElasticError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]string{
+			"type":   elasticErrorType(status),
+			"reason": err.Error(),
+		},
+		"status": status,
+	})
+}
 
-		anomalies := s.ae.ProcessTemplate(tmpl)
-		s.ale.AddAnomalies(anomalies)
+func elasticErrorType(status int) string {
+	if status == http.StatusTooManyRequests {
+		return "es_rejected_execution_exception"
 	}
+	return "illegal_argument_exception"
 }
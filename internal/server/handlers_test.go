@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"log-analyzer/internal/common"
+	"log-analyzer/internal/elastic"
+	"log-analyzer/internal/ingest"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	traceID = "5b8efff798038103d269b633813fc60c"
+	spanID  = "eee19b7ec3c1b174"
+	podUID  = "0b1c2d3e-0000-4000-8000-000000000001"
+)
+
+// Serve a request of a fixture in testdata with a server that only queues
+// events, returns the response and the events queued
+func serveFixture(t *testing.T, handler func(*Server) http.HandlerFunc, req *http.Request, fixture string) (*httptest.ResponseRecorder, []common.LogEvent) {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+
+	// One worker keeps the events in order. The fixtures hold more events
+	// than its queue, so they are queued in chunks
+	var events []common.LogEvent
+	s := &Server{
+		queue:        ingest.NewQueue(2, 1, func(le common.LogEvent) { events = append(events, le) }),
+		maxBodyBytes: 1 << 20,
+	}
+	s.queue.Start()
+
+	w := httptest.NewRecorder()
+	handler(s).ServeHTTP(w, req)
+	s.queue.Close()
+
+	// Decoders differ on the location of event times
+	for i := range events {
+		if !events[i].Time.IsZero() {
+			events[i].Time = events[i].Time.UTC()
+		}
+	}
+	return w, events
+}
+
+func assertEvents(t *testing.T, got, want []common.LogEvent) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("event %d:\ngot  %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestOTLPLogs(t *testing.T) {
+	pod := common.K8sMetadata{
+		PodName:       "api-7d9f-abcde",
+		PodID:         podUID,
+		Namespace:     "shop",
+		ContainerName: "api",
+		ContainerImg:  "shop/api:1.4.2",
+		Labels: map[string]interface{}{
+			"k8s.namespace.name":   "shop",
+			"k8s.pod.name":         "api-7d9f-abcde",
+			"k8s.pod.uid":          podUID,
+			"k8s.container.name":   "api",
+			"container.image.name": "shop/api",
+			"container.image.tag":  "1.4.2",
+		},
+	}
+	host := common.K8sMetadata{
+		PodName:       "vm-1",
+		PodID:         "vm-1",
+		ContainerName: "cron",
+		Host:          "vm-1",
+		Labels:        map[string]interface{}{"host.name": "vm-1", "service.name": "cron"},
+	}
+	want := []common.LogEvent{
+		{
+			Time: time.Unix(0, 1764000000123456789).UTC(), Log: "order 1234 placed", Level: common.LevelInfo,
+			TraceID: traceID, SpanID: spanID, K8sMetadata: pod,
+		},
+		{
+			Time: time.Unix(1764000001, 0).UTC(), Log: `{"message":"payment declined"}`, Level: common.LevelError,
+			K8sMetadata: pod,
+		},
+		{
+			Time: time.Unix(1764000003, 0).UTC(), Log: "backup failed", Level: common.LevelError,
+			K8sMetadata: host,
+		},
+	}
+
+	tests := []struct {
+		name        string
+		fixture     string
+		contentType string
+		unmarshal   func([]byte, proto.Message) error
+	}{
+		{name: "json", fixture: "otlp.json", contentType: "application/json", unmarshal: protojson.Unmarshal},
+		{name: "protobuf", fixture: "otlp.pb", contentType: "application/x-protobuf", unmarshal: proto.Unmarshal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/logs", nil)
+			req.Header.Set("Content-Type", tt.contentType)
+			w, events := serveFixture(t, func(s *Server) http.HandlerFunc { return s.OTLPLogs }, req, tt.fixture)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			var resp collogspb.ExportLogsServiceResponse
+			if err := tt.unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.GetPartialSuccess().GetRejectedLogRecords(); got != 1 {
+				t.Errorf("got %d rejected records, want the one without a body", got)
+			}
+			assertEvents(t, events, want)
+		})
+	}
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/logs", nil)
+		req.Header.Set("Content-Type", "text/plain")
+		w, events := serveFixture(t, func(s *Server) http.HandlerFunc { return s.OTLPLogs }, req, "otlp.json")
+		if w.Code != http.StatusUnsupportedMediaType || len(events) > 0 {
+			t.Fatalf("got status %d and %d events, want %d and none", w.Code, len(events), http.StatusUnsupportedMediaType)
+		}
+	})
+}
+
+func TestLokiPush(t *testing.T) {
+	pod := common.K8sMetadata{
+		PodName:       "api-7d9f-abcde",
+		PodID:         "api-7d9f-abcde",
+		Namespace:     "shop",
+		ContainerName: "api",
+		Labels: map[string]interface{}{
+			"namespace": "shop", "pod": "api-7d9f-abcde", "container": "api", "level": "info",
+		},
+	}
+	host := common.K8sMetadata{
+		PodName:       "vm-1",
+		PodID:         "vm-1",
+		ContainerName: "cron",
+		Host:          "vm-1",
+		Labels:        map[string]interface{}{"host": "vm-1", "job": "cron"},
+	}
+	want := []common.LogEvent{
+		{Time: time.Unix(0, 1764000000123456789).UTC(), Log: "order 1234 placed", Level: "info", K8sMetadata: pod},
+		{Time: time.Unix(1764000001, 0).UTC(), Log: "payment declined", Level: "error", TraceID: traceID, K8sMetadata: pod},
+		{Time: time.Unix(1764000003, 0).UTC(), Log: "backup failed", K8sMetadata: host},
+	}
+
+	tests := []struct {
+		name        string
+		fixture     string
+		contentType string
+		status      int
+	}{
+		// The JSON fixture holds an entry without a line, the others are
+		// ingested and the push is refused like Loki does
+		{name: "json", fixture: "loki.json", contentType: "application/json", status: http.StatusBadRequest},
+		{name: "snappy protobuf", fixture: "loki.pb", contentType: "application/x-protobuf", status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", nil)
+			req.Header.Set("Content-Type", tt.contentType)
+			w, events := serveFixture(t, func(s *Server) http.HandlerFunc { return s.LokiPush }, req, tt.fixture)
+
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			assertEvents(t, events, want)
+		})
+	}
+}
+
+func TestElasticBulk(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/logs/_bulk", nil)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.SetPathValue("index", "logs")
+	w, events := serveFixture(t, func(s *Server) http.HandlerFunc { return s.ElasticBulk }, req, "bulk.ndjson")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp elastic.BulkResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Errors {
+		t.Error("response doesn't report the failed items")
+	}
+
+	wantItems := []struct {
+		action string
+		index  string
+		status int
+	}{
+		{"index", "logs-shop", http.StatusCreated},
+		{"create", "logs", http.StatusCreated},
+		{"delete", "logs-shop", http.StatusNotFound},
+		{"update", "logs", http.StatusOK},
+		{"index", "logs", http.StatusBadRequest},
+		{"index", "logs", http.StatusBadRequest},
+	}
+	if len(resp.Items) != len(wantItems) {
+		t.Fatalf("got %d items, want %d", len(resp.Items), len(wantItems))
+	}
+	for i, want := range wantItems {
+		item := resp.Items[i][want.action]
+		if item == nil || item.Index != want.index || item.Status != want.status {
+			t.Errorf("item %d: got %v, want %s of %s with status %d", i, resp.Items[i], want.action, want.index, want.status)
+		}
+	}
+
+	assertEvents(t, events, []common.LogEvent{
+		{
+			Time: time.Date(2025, 11, 24, 16, 0, 0, 123000000, time.UTC), Log: "order 1234 placed", Level: "info",
+			K8sMetadata: common.K8sMetadata{PodName: "api-7d9f-abcde", PodID: podUID, Namespace: "shop", ContainerName: "api"},
+		},
+		{
+			Time: time.Date(2025, 11, 24, 16, 0, 1, 0, time.UTC), Log: "payment declined", Level: "error", TraceID: traceID,
+			K8sMetadata: common.K8sMetadata{PodName: "api-7d9f-abcde", PodID: "api-7d9f-abcde", Namespace: "shop", ContainerName: "api"},
+		},
+		{
+			Log:         "backup failed",
+			K8sMetadata: common.K8sMetadata{PodName: "vm-1", PodID: "vm-1", Host: "vm-1"},
+		},
+	})
+
+	t.Run("queue closed", func(t *testing.T) {
+		b, err := os.ReadFile(filepath.Join("testdata", "bulk.ndjson"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The chunk of the third event waits for room until the queue
+		// closes
+		s := &Server{queue: ingest.NewQueue(2, 1, func(common.LogEvent) {})}
+		go func() {
+			for s.queue.Stats().Enqueued < 2 {
+				time.Sleep(time.Millisecond)
+			}
+			s.queue.Close()
+		}()
+
+		req := httptest.NewRequest(http.MethodPost, "/logs/_bulk", bytes.NewReader(b))
+		req.SetPathValue("index", "logs")
+		w := httptest.NewRecorder()
+		s.ElasticBulk(w, req)
+
+		var resp elastic.BulkResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %s", err, w.Body)
+		}
+		var statuses []int
+		for _, action := range resp.Items {
+			for _, item := range action {
+				statuses = append(statuses, item.Status)
+			}
+		}
+		want := []int{http.StatusCreated, http.StatusCreated, http.StatusNotFound, http.StatusServiceUnavailable, http.StatusBadRequest, http.StatusBadRequest}
+		if w.Code != http.StatusOK || fmt.Sprint(statuses) != fmt.Sprint(want) {
+			t.Fatalf("got status %d with items %v, want %d with items %v", w.Code, statuses, http.StatusOK, want)
+		}
+	})
+
+	t.Run("invalid action", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/_bulk", bytes.NewBufferString("{\"index\":{}}\n{\"message\":\"a\"}\n{\"upsert\":{}}\n{}\n"))
+		w := httptest.NewRecorder()
+		s := &Server{queue: ingest.NewQueue(100, 1, func(common.LogEvent) {})}
+		s.ElasticBulk(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+		}
+		if st := s.queue.Stats(); st.Enqueued != 0 {
+			t.Fatalf("got %d events queued of a refused request, want none", st.Enqueued)
+		}
+	})
+}
+
+// NDJSON body of events logging each of lines, a line "-" is an event that
+// doesn't decode
+func ndjson(lines ...string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		if line == "-" {
+			b.WriteString("{\"log\": 1}\n")
+			continue
+		}
+		fmt.Fprintf(&b, "{\"log\": %q}\n", line)
+	}
+	return b.String()
+}
+
+func serveIngest(t *testing.T, s *Server, body string) (int, IngestResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.Ingest(w, req)
+
+	var resp IngestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	return w.Code, resp
+}
+
+func TestIngest(t *testing.T) {
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = fmt.Sprint("line ", i)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   IngestResponse
+		logs   []string
+	}{
+		{
+			name:   "ndjson",
+			body:   ndjson("a", "-", "b"),
+			status: http.StatusOK,
+			want:   IngestResponse{Accepted: 2, Rejected: 1},
+			logs:   []string{"a", "b"},
+		},
+		{
+			name:   "json array",
+			body:   `[{"log": "a"}, {"log": 1}, {"log": "b"}]`,
+			status: http.StatusOK,
+			want:   IngestResponse{Accepted: 2, Rejected: 1},
+			logs:   []string{"a", "b"},
+		},
+		{
+			// Larger than the queue, chunks wait for the worker
+			name:   "larger than the queue",
+			body:   ndjson(lines...),
+			status: http.StatusOK,
+			want:   IngestResponse{Accepted: len(lines)},
+			logs:   lines,
+		},
+		{
+			name:   "truncated",
+			body:   `[{"log": "a"}, {"log": 1}, {"log": "b"}, {"log": "c"`,
+			status: http.StatusMultiStatus,
+			want:   IngestResponse{Accepted: 2, Rejected: 1},
+			logs:   []string{"a", "b"},
+		},
+		{
+			name:   "malformed",
+			body:   `[{"log": "a"`,
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			s := &Server{queue: ingest.NewQueue(4, 1, func(le common.LogEvent) { logs = append(logs, le.Log) })}
+			s.queue.Start()
+			status, resp := serveIngest(t, s, tt.body)
+			s.queue.Close()
+
+			resp.Error = ""
+			if status != tt.status || resp != tt.want {
+				t.Fatalf("got %d %+v, want %d %+v", status, resp, tt.status, tt.want)
+			}
+			if fmt.Sprint(logs) != fmt.Sprint(tt.logs) {
+				t.Fatalf("got logs %v, want %v", logs, tt.logs)
+			}
+		})
+	}
+}
+
+func TestIngestQueueFull(t *testing.T) {
+	// Not started, so nothing leaves the queue
+	s := &Server{queue: ingest.NewQueue(2, 1, func(common.LogEvent) {})}
+	if err := s.Submit([]common.LogEvent{{Log: "queued"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, resp := serveIngest(t, s, ndjson("a", "b"))
+	if status != http.StatusTooManyRequests || resp.Accepted != 0 {
+		t.Fatalf("got %d %+v, want %d with nothing accepted", status, resp, http.StatusTooManyRequests)
+	}
+	if st := s.queue.Stats(); st.Enqueued != 1 {
+		t.Fatalf("got %d events queued, want only the first one", st.Enqueued)
+	}
+}
+
+func TestIngestQueueClosed(t *testing.T) {
+	// Chunks of 2 events, the second one waits for room until the queue
+	// closes
+	s := &Server{queue: ingest.NewQueue(2, 1, func(common.LogEvent) {})}
+	go func() {
+		for s.queue.Stats().Enqueued < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		s.queue.Close()
+	}()
+
+	status, resp := serveIngest(t, s, ndjson("a", "b", "-", "c", "d"))
+	if status != http.StatusMultiStatus || resp.Accepted != 2 || resp.Rejected != 1 {
+		t.Fatalf("got %d %+v, want %d resuming after the first 3 events", status, resp, http.StatusMultiStatus)
+	}
+	if st := s.queue.Stats(); st.Enqueued != 2 {
+		t.Fatalf("got %d events queued, want 2", st.Enqueued)
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Prometheus text exposition of the ingest queue
+func (s *Server) Metrics(w http.ResponseWriter, req *http.Request) {
+	st := s.queue.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("log_analyzer_ingest_queue_depth", "gauge", "Log events waiting to be processed.", st.Depth)
+	metric("log_analyzer_ingest_queue_capacity", "gauge", "Max log events waiting to be processed.", st.Capacity)
+	metric("log_analyzer_ingest_queue_workers", "gauge", "Workers processing queued log events.", st.Workers)
+	metric("log_analyzer_ingest_queue_lag_seconds", "gauge", "Longest time the log events being processed waited in the queue.", st.Lag.Seconds())
+	metric("log_analyzer_ingest_events_enqueued_total", "counter", "Log events accepted into the queue.", st.Enqueued)
+	metric("log_analyzer_ingest_events_processed_total", "counter", "Log events processed.", st.Processed)
+	metric("log_analyzer_ingest_events_rejected_total", "counter", "Log events turned away because the queue was full.", st.Rejected)
+}
@@ -1,56 +1,264 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log-analyzer/detectors/frequency"
+	"log-analyzer/detectors/newtemplate"
 	"log-analyzer/detectors/sequence"
+	"log-analyzer/detectors/silence"
 	"log-analyzer/detectors/timing"
 
 	"log-analyzer/internal/alert"
 	"log-analyzer/internal/anomaly"
+	"log-analyzer/internal/common"
 	"log-analyzer/internal/db"
+	"log-analyzer/internal/ingest"
 	p "log-analyzer/internal/parser"
+	"log/slog"
 	"time"
 )
 
 const (
-	databaseFile = "data.db"
+	expiryInterval = time.Second
 )
 
-func NewServer() (*Server, error) {
-	tdb, err := db.NewTemplateDB(databaseFile)
-	if err != nil {
-		return nil, err
+func NewServer(cfg Config) (*Server, error) {
+	rules := p.DefaultRules()
+	if cfg.RulesFile != "" {
+		var err error
+		if rules, err = p.LoadRules(cfg.RulesFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var store db.Store = db.NewMemoryStore()
+	if cfg.DatabaseFile != "" {
+		tdb, err := db.NewTemplateDB(cfg.DatabaseFile)
+		if err != nil {
+			return nil, err
+		}
+		store = tdb
 	}
 
-	lp, err := p.NewLogParser(tdb)
+	lp, err := p.NewLogParser(store, p.Options{
+		Similarity:    cfg.TemplateSimilarity,
+		MergeDistance: cfg.TemplateMergeDistance,
+		Rules:         rules,
+		Scope:         cfg.TemplateScope,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	ae, err := anomaly.NewAnomalyEngine(tdb)
+	clock := &common.EventClock{
+		Policy:      cfg.LatePolicy,
+		MaxLateness: cfg.MaxLateness,
+		MaxSkew:     cfg.MaxClockSkew,
+	}
+
+	ae, err := anomaly.NewAnomalyEngine(store)
 	if err != nil {
 		return nil, err
 	}
-	ae.AddAnomalyDetector(&frequency.FrequencyDetector{})
+	ae.AddAnomalyDetector(&newtemplate.NewTemplateDetector{
+		GracePeriod:   cfg.NewTemplateGracePeriod,
+		Severity:      cfg.NewTemplateSeverity,
+		ErrorSeverity: cfg.NewTemplateErrorSeverity,
+		ResolveAfter:  cfg.NewTemplateResolveAfter,
+		Clock:         clock,
+	})
+	ae.AddAnomalyDetector(&frequency.FrequencyDetector{Clock: clock})
 	ae.AddAnomalyDetector(&sequence.SequenceDetector{})
 	ae.AddAnomalyDetector(&timing.TimingDetector{})
+	ae.AddAnomalyDetector(&silence.SilenceDetector{Clock: clock})
 
 	ale := alert.NewAlertEngine()
-	done := make(<-chan bool)
-
-	ale.Start(time.Second*5, done)
-	ae.Start(done)
+	ae.OnAnomalies(ale.AddAnomalies)
+	if err := ae.Init(); err != nil {
+		return nil, err
+	}
 
 	s := Server{
-		lp:  lp,
-		ae:  ae,
-		ale: ale,
+		store: store,
+		lp:    lp,
+		ae:    ae,
+		ale:   ale,
+		clock: clock,
+		stages: ingest.Chain{
+			ingest.NewReassembler(cfg.PartialTimeout, cfg.PartialMaxBytes),
+			ingest.NewMultilineGrouper(cfg.MultilineTimeout, cfg.MultilineMaxLines),
+		},
+		maxBodyBytes: cfg.MaxBodyBytes,
+		done:         make(chan bool),
+	}
+	s.queue = ingest.NewQueue(cfg.QueueSize, cfg.QueueWorkers, func(le common.LogEvent) {
+		s.Process(le)
+	})
+	// Held back events are released by the worker of their stream, in order
+	// with the events that follow them
+	s.queue.OnTick(func(now time.Time, owns func(common.LogEvent) bool) {
+		s.processAll(s.stages.Expire(now, owns))
+	})
+
+	// Offline runs replay historic events, wall-clock driven flushes and
+	// sweeps would only report noise
+	if !cfg.Offline {
+		if ps, ok := store.(db.Persister); ok {
+			ps.StartFlush(cfg.StatsFlushInterval, s.done)
+			ps.StartMaintenance(db.Retention{
+				Interval:    cfg.CompactInterval,
+				DailyCounts: cfg.DailyCountsRetention,
+				GonePods:    cfg.GonePodRetention,
+				Checkpoint:  cfg.CheckpointInterval,
+				Vacuum:      cfg.VacuumInterval,
+				Clock:       clock,
+			}, s.done)
+		}
+		ale.Start(time.Second*5, s.done)
+		ae.Start(s.done)
+		s.startExpiry(s.done)
+		s.queue.Start()
 	}
 	return &s, nil
 }
 
 type Server struct {
-	lp  *p.LogParser
-	ae  *anomaly.AnomalyEngine
-	ale *alert.AlertEngine
+	store  db.Store
+	lp     *p.LogParser
+	ae     *anomaly.AnomalyEngine
+	ale    *alert.AlertEngine
+	clock  *common.EventClock
+	stages ingest.Chain  // run ahead of the parser
+	queue  *ingest.Queue // between the receivers and Process
+
+	maxBodyBytes int64
+	done         chan bool // closed on shutdown, stops the background schedulers
+}
+
+// Queue events for processing, all of them or none if the queue is full
+func (s *Server) Submit(events []common.LogEvent) error {
+	return s.queue.TryEnqueue(events)
+}
+
+// Queue events for processing, waiting for room in the queue as needed
+func (s *Server) SubmitWait(events []common.LogEvent) error {
+	return s.queue.Enqueue(events)
+}
+
+// Run a log event through the ingest stages, parser and anomaly detectors.
+// Returns the anomalies detected for the events released by the stages
+func (s *Server) Process(le common.LogEvent) []anomaly.Anomaly {
+	return s.processAll(s.stages.Add(le))
+}
+
+// Process all events held back by the ingest stages
+func (s *Server) Flush() []anomaly.Anomaly {
+	return s.processAll(s.stages.Flush())
+}
+
+// Periodically have the queue workers process the events held back by the
+// ingest stages for too long
+func (s *Server) startExpiry(done <-chan bool) {
+	ticker := time.NewTicker(expiryInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.queue.Tick(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) processAll(events []common.LogEvent) []anomaly.Anomaly {
+	var anomalies []anomaly.Anomaly
+	for _, le := range events {
+		anomalies = append(anomalies, s.process(le)...)
+	}
+	return anomalies
+}
+
+func (s *Server) process(le common.LogEvent) []anomaly.Anomaly {
+	ts, ok := s.clock.Resolve(le.Timestamp())
+	if !ok {
+		slog.Debug(fmt.Sprintf("Dropping late log event from %s", le.Timestamp().Format(time.RFC3339)))
+		return nil
+	}
+
+	tmpl, newTemplate := s.lp.ParseLog(le.Log, ts, le.K8sMetadata)
+	if level := common.NormalizeLevel(le.Level); level != "" {
+		tmpl.Level = level
+	}
+	tmpl.TraceID, tmpl.SpanID = le.TraceID, le.SpanID
+	if newTemplate {
+		slog.Debug(fmt.Sprintf("New template detected: %s in %s", tmpl.ID, tmpl.K8sMetadata.Workload()))
+	}
+
+	anomalies := s.ae.ProcessTemplate(tmpl)
+	s.ale.AddAnomalies(anomalies)
+	return anomalies
+}
+
+// Get all templates with their counts
+func (s *Server) TemplateCounts() ([]db.TemplateCount, error) {
+	return s.store.GetTemplateCounts()
+}
+
+// Get counts of templates with the same text summed over all scopes
+func (s *Server) CrossScopeCounts() ([]db.CrossScopeCount, error) {
+	return s.store.GetCrossScopeCounts()
+}
+
+func (s *Server) Close() error {
+	return s.store.Close()
+}
+
+// Stop processing within the deadline of ctx: drain the ingest queue,
+// process the events held back by the ingest stages, stop the schedulers
+// with a final alert flush, then flush the template counters, checkpoint
+// and close the DB.
+// The receivers must be stopped first
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	drained := make(chan struct{})
+	go func() {
+		s.queue.Close()
+		s.Flush()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("ingest not drained: %w", ctx.Err()))
+	}
+
+	close(s.done)
+	flushed := make(chan struct{})
+	go func() {
+		s.ale.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("alerts not flushed: %w", ctx.Err()))
+	}
+
+	if ps, ok := s.store.(db.Persister); ok {
+		if err := ps.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush template counters: %w", err))
+		}
+		if err := ps.Checkpoint(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to checkpoint DB: %w", err))
+		}
+	}
+	if err := s.store.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close DB: %w", err))
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,266 @@
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log-analyzer/internal/common"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nilValue   = "-"
+	defaultPri = 13 // user.notice, for messages without a PRI part
+	utf8BOM    = "\xef\xbb\xbf"
+)
+
+var errNoPri = errors.New("missing PRI")
+
+// A syslog message of either RFC 5424 or RFC 3164 format
+type Message struct {
+	Facility       int
+	Severity       int
+	Timestamp      time.Time // zero if the message has none
+	Hostname       string
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData map[string]map[string]string // SD-ID to params
+	Body           string
+}
+
+// Syslog severities, most severe first
+var severityLevels = [8]string{
+	common.LevelFatal, // emergency
+	common.LevelFatal, // alert
+	common.LevelFatal, // critical
+	common.LevelError, // error
+	common.LevelWarn,  // warning
+	common.LevelInfo,  // notice
+	common.LevelInfo,  // informational
+	common.LevelDebug, // debug
+}
+
+// Map the message onto a log event. The host acts as the pod and the
+// app-name as the container, so templates, transitions and scopes are kept
+// per host and app
+func (m Message) Event() common.LogEvent {
+	le := common.LogEvent{
+		Time:  m.Timestamp,
+		Log:   m.Body,
+		Level: severityLevels[m.Severity],
+		K8sMetadata: common.K8sMetadata{
+			PodName:       m.Hostname,
+			PodID:         m.Hostname,
+			Host:          m.Hostname,
+			ContainerName: m.AppName,
+			Labels: map[string]interface{}{
+				"facility": strconv.Itoa(m.Facility),
+				"severity": strconv.Itoa(m.Severity),
+			},
+		},
+	}
+	if m.ProcID != "" {
+		le.K8sMetadata.Labels["procid"] = m.ProcID
+	}
+	if m.MsgID != "" {
+		le.K8sMetadata.Labels["msgid"] = m.MsgID
+	}
+	return le
+}
+
+// Parse a syslog message, telling RFC 5424 and RFC 3164 apart by the version
+// following the PRI part. Anything not following RFC 3164 to the letter is
+// parsed as leniently as syslog daemons do. RFC 3164 timestamps carry no
+// zone, they are read in loc, the zone of the senders
+func Parse(b []byte, now time.Time, loc *time.Location) (Message, error) {
+	b = bytes.TrimRight(b, "\r\n\x00")
+	pri, rest, err := parsePri(b)
+	if errors.Is(err, errNoPri) {
+		pri, rest = defaultPri, b
+	} else if err != nil {
+		return Message{}, err
+	}
+
+	m := Message{Facility: pri / 8, Severity: pri % 8}
+	if len(rest) >= 2 && rest[0] == '1' && rest[1] == ' ' {
+		return m, m.parse5424(string(rest[2:]))
+	}
+	m.parse3164(string(rest), now, loc)
+	return m, nil
+}
+
+func parsePri(b []byte) (int, []byte, error) {
+	if len(b) == 0 || b[0] != '<' {
+		return 0, b, errNoPri
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return 0, b, fmt.Errorf("invalid PRI")
+	}
+
+	// 1 to 3 digits, Atoi alone would take signs
+	pri := 0
+	for _, c := range b[1:end] {
+		if c < '0' || c > '9' {
+			return 0, b, fmt.Errorf("invalid PRI %q", b[1:end])
+		}
+		pri = pri*10 + int(c-'0')
+	}
+	if pri > 191 {
+		return 0, b, fmt.Errorf("invalid PRI %q", b[1:end])
+	}
+	return pri, b[end+1:], nil
+}
+
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func (m *Message) parse5424(s string) error {
+	var fields [5]string
+	for i := range fields {
+		var ok bool
+		fields[i], s, ok = strings.Cut(s, " ")
+		if !ok && i < len(fields)-1 {
+			return fmt.Errorf("truncated RFC 5424 header")
+		}
+	}
+	if fields[0] != nilValue {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid RFC 5424 timestamp: %w", err)
+		}
+		m.Timestamp = ts.UTC()
+	}
+	m.Hostname = orEmpty(fields[1])
+	m.AppName = orEmpty(fields[2])
+	m.ProcID = orEmpty(fields[3])
+	m.MsgID = orEmpty(fields[4])
+
+	sd, rest, err := parseStructuredData(s)
+	if err != nil {
+		return err
+	}
+	m.StructuredData = sd
+	m.Body = strings.TrimPrefix(strings.TrimPrefix(rest, " "), utf8BOM)
+	return nil
+}
+
+// Parse "-" or one or more [SD-ID PARAM="VALUE" ...] elements and return
+// the text after them
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+	if strings.HasPrefix(s, nilValue) {
+		return nil, s[len(nilValue):], nil
+	}
+
+	sd := make(map[string]map[string]string)
+	for strings.HasPrefix(s, "[") {
+		end := strings.IndexAny(s, " ]")
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated structured data")
+		}
+		params := make(map[string]string)
+		sd[s[1:end]] = params
+		s = s[end:]
+
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+			name, rest, ok := strings.Cut(s, `="`)
+			if !ok {
+				return nil, "", fmt.Errorf("invalid structured data param")
+			}
+			var value strings.Builder
+			i := 0
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				// ", \ and ] are escaped with a backslash
+				if rest[i] == '\\' && i+1 < len(rest) && strings.IndexByte(`"\]`, rest[i+1]) >= 0 {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			if i == len(rest) {
+				return nil, "", fmt.Errorf("unterminated structured data param")
+			}
+			params[name] = value.String()
+			s = rest[i+1:]
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", fmt.Errorf("unterminated structured data")
+		}
+		s = s[1:]
+	}
+	if len(sd) == 0 {
+		return nil, "", fmt.Errorf("invalid structured data")
+	}
+	return sd, s, nil
+}
+
+// Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+func (m *Message) parse3164(s string, now time.Time, loc *time.Location) {
+	if ts, rest, ok := parse3164Timestamp(s, now, loc); ok {
+		m.Timestamp = ts
+		s = rest
+
+		// The hostname is left out by some senders, the tag comes first then
+		if host, rest, ok := strings.Cut(s, " "); ok && !isTag(host) {
+			m.Hostname = host
+			s = rest
+		}
+	}
+
+	if tag, rest, ok := strings.Cut(s, ":"); ok && isTag(tag+":") {
+		m.AppName = tag
+		if name, pid, ok := strings.Cut(tag, "["); ok {
+			m.AppName = name
+			m.ProcID = strings.TrimSuffix(pid, "]")
+		}
+		s = strings.TrimPrefix(rest, " ")
+	}
+	m.Body = s
+}
+
+// Parse the RFC 3164 "Jan _2 15:04:05" timestamp, which has no year and no
+// zone, or the RFC 3339 timestamp written by some daemons instead. The former
+// is the local time of the sender, taken in loc and its year from now
+func parse3164Timestamp(s string, now time.Time, loc *time.Location) (time.Time, string, bool) {
+	const stamp = "Jan _2 15:04:05"
+	if len(s) > len(stamp) && s[len(stamp)] == ' ' {
+		if ts, err := time.Parse(stamp, s[:len(stamp)]); err == nil {
+			now = now.In(loc)
+			ts = time.Date(now.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, loc)
+			// Sent last year around new year
+			if ts.After(now.AddDate(0, 1, 0)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			return ts.UTC(), s[len(stamp)+1:], true
+		}
+	}
+	if field, rest, ok := strings.Cut(s, " "); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, field); err == nil {
+			return ts.UTC(), rest, true
+		}
+	}
+	return time.Time{}, s, false
+}
+
+// True if s looks like a "name:" or "name[pid]:" tag
+func isTag(s string) bool {
+	name, ok := strings.CutSuffix(s, ":")
+	if !ok || name == "" || len(name) > 48 {
+		return false
+	}
+	if open := strings.IndexByte(name, '['); open >= 0 {
+		if !strings.HasSuffix(name, "]") {
+			return false
+		}
+		name = name[:open]
+	}
+	return name != "" && !strings.ContainsAny(name, " []")
+}
+
+func orEmpty(s string) string {
+	if s == nilValue {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,165 @@
+package syslog
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2025, 11, 24, 13, 0, 0, 0, time.UTC)
+	tokyo := time.FixedZone("JST", 9*60*60)
+
+	tests := []struct {
+		name    string
+		in      string
+		loc     *time.Location // of RFC 3164 timestamps, UTC if nil
+		now     time.Time      // time of receipt, now if zero
+		want    Message
+		wantErr bool
+	}{
+		{
+			name: "rfc5424",
+			in:   `<165>1 2025-11-24T12:34:56.789Z web-1 nginx 42 ID47 - GET /health 200`,
+			want: Message{
+				Facility: 20, Severity: 5,
+				Timestamp: time.Date(2025, 11, 24, 12, 34, 56, 789000000, time.UTC),
+				Hostname:  "web-1", AppName: "nginx", ProcID: "42", MsgID: "ID47",
+				Body: "GET /health 200",
+			},
+		},
+		{
+			name: "rfc5424 nil values",
+			in:   "<11>1 - - - - - -\n",
+			want: Message{Facility: 1, Severity: 3},
+		},
+		{
+			name: "rfc5424 structured data",
+			in:   `<14>1 2025-11-24T12:34:56+01:00 db-1 postgres - - [origin ip="10.0.0.1"][meta seq="7" note="a \"quoted\] \\ value"] ` + utf8BOM + `checkpoint done`,
+			want: Message{
+				Facility: 1, Severity: 6,
+				Timestamp: time.Date(2025, 11, 24, 11, 34, 56, 0, time.UTC),
+				Hostname:  "db-1", AppName: "postgres",
+				StructuredData: map[string]map[string]string{
+					"origin": {"ip": "10.0.0.1"},
+					"meta":   {"seq": "7", "note": `a "quoted] \ value`},
+				},
+				Body: "checkpoint done",
+			},
+		},
+		{
+			name: "rfc5424 structured data without params",
+			in:   `<14>1 - host app - - [exampleSDID@32473]`,
+			want: Message{
+				Facility: 1, Severity: 6, Hostname: "host", AppName: "app",
+				StructuredData: map[string]map[string]string{"exampleSDID@32473": {}},
+			},
+		},
+		{
+			name: "rfc3164",
+			in:   `<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8`,
+			want: Message{
+				Facility: 4, Severity: 2,
+				Timestamp: time.Date(2025, 10, 11, 22, 14, 15, 0, time.UTC),
+				Hostname:  "mymachine", AppName: "su", ProcID: "123",
+				Body: "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "rfc3164 without hostname",
+			in:   `<13>Nov  2 09:00:00 cron: job started`,
+			want: Message{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2025, 11, 2, 9, 0, 0, 0, time.UTC),
+				AppName:   "cron", Body: "job started",
+			},
+		},
+		{
+			name: "rfc3164 last year",
+			in:   `<13>Dec 31 23:59:59 host app: bye`,
+			want: Message{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC),
+				Hostname:  "host", AppName: "app", Body: "bye",
+			},
+		},
+		{
+			name: "rfc3164 location",
+			in:   `<13>Nov 24 08:00:00 host app: hi`,
+			loc:  tokyo,
+			want: Message{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2025, 11, 23, 23, 0, 0, 0, time.UTC),
+				Hostname:  "host", AppName: "app", Body: "hi",
+			},
+		},
+		{
+			// Already the new year in the zone of the sender
+			name: "rfc3164 location new year",
+			in:   `<13>Jan  1 08:00:00 host app: hi`,
+			loc:  tokyo,
+			now:  time.Date(2025, 12, 31, 23, 30, 0, 0, time.UTC),
+			want: Message{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2025, 12, 31, 23, 0, 0, 0, time.UTC),
+				Hostname:  "host", AppName: "app", Body: "hi",
+			},
+		},
+		{
+			name: "missing pri",
+			in:   `plain message`,
+			want: Message{Facility: 1, Severity: 5, Body: "plain message"},
+		},
+		{name: "negative pri", in: `<-1>1 - - - - - -`, wantErr: true},
+		{name: "signed pri", in: `<+1>1 - - - - - -`, wantErr: true},
+		{name: "pri too large", in: `<192>1 - - - - - -`, wantErr: true},
+		{name: "overlong pri", in: `<0013>1 - - - - - -`, wantErr: true},
+		{name: "empty pri", in: `<>1 - - - - - -`, wantErr: true},
+		{name: "unterminated pri", in: `<13 hello`, wantErr: true},
+		{name: "bad timestamp", in: `<13>1 yesterday host app - - -`, wantErr: true},
+		{name: "truncated header", in: `<13>1 - host`, wantErr: true},
+		{name: "unterminated structured data", in: `<13>1 - host app - - [id k="v"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := tt.loc
+			if loc == nil {
+				loc = time.UTC
+			}
+			received := tt.now
+			if received.IsZero() {
+				received = now
+			}
+			got, err := Parse([]byte(tt.in), received, loc)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got  %+v\nwant %+v", got, tt.want)
+			}
+
+			// Every parsed message maps onto an event
+			got.Event()
+		})
+	}
+}
+
+func TestEventLevel(t *testing.T) {
+	for pri, want := range map[int]string{0: "fatal", 3: "error", 4: "warn", 190: "info", 191: "debug"} {
+		m, err := Parse([]byte("<"+strconv.Itoa(pri)+">1 - - - - - -"), time.Now(), time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Event().Level; got != want {
+			t.Errorf("PRI %d: got level %q, want %q", pri, got, want)
+		}
+	}
+}
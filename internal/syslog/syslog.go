@@ -0,0 +1,208 @@
+// Package syslog implements a syslog receiver for RFC 5424 and RFC 3164
+// messages over UDP, TCP and TLS (RFC 5425). TCP streams may use octet
+// counting or LF-terminated framing (RFC 6587), chosen per message.
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log-analyzer/internal/common"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxMessageSize = 64 * 1024
+	idleTimeout    = 5 * time.Minute
+)
+
+// Listener receives syslog messages and feeds them to Process as log events
+type Listener struct {
+	Process func(common.LogEvent)
+	// Zone of the RFC 3164 timestamps, which carry none. Syslog daemons write
+	// them in the local time of their host, so it defaults to time.Local
+	Location *time.Location
+
+	mu      sync.Mutex
+	closers map[io.Closer]struct{} // listeners, packet conns and stream conns
+	wg      sync.WaitGroup
+}
+
+func NewListener(process func(common.LogEvent)) *Listener {
+	return &Listener{
+		Process:  process,
+		Location: time.Local,
+		closers:  make(map[io.Closer]struct{}),
+	}
+}
+
+func (l *Listener) ListenAndServeUDP(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return l.ServeUDP(pc)
+}
+
+func (l *Listener) ListenAndServeTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.ServeTCP(ln)
+}
+
+func (l *Listener) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	return l.ServeTCP(ln)
+}
+
+// Read one message per datagram from pc until it is closed
+func (l *Listener) ServeUDP(pc net.PacketConn) error {
+	l.track(pc)
+	defer l.untrack(pc)
+
+	slog.Info(fmt.Sprintf("Syslog listener on udp %s", pc.LocalAddr()))
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		l.handle(buf[:n], addr)
+	}
+}
+
+// Accept stream connections, plain or TLS, on ln until it is closed
+func (l *Listener) ServeTCP(ln net.Listener) error {
+	l.track(ln)
+	defer l.untrack(ln)
+
+	slog.Info(fmt.Sprintf("Syslog listener on tcp %s", ln.Addr()))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		l.track(conn)
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer l.untrack(conn)
+			l.serveConn(conn)
+		}()
+	}
+}
+
+// Stop all listeners, close the open connections and wait for the messages
+// being processed
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	for c := range l.closers {
+		c.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return nil
+}
+
+func (l *Listener) track(c io.Closer) {
+	l.mu.Lock()
+	l.closers[c] = struct{}{}
+	l.mu.Unlock()
+}
+
+func (l *Listener) untrack(c io.Closer) {
+	l.mu.Lock()
+	delete(l.closers, c)
+	l.mu.Unlock()
+}
+
+func (l *Listener) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		frame, err := readFrame(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn(fmt.Sprintf("Closing syslog connection from %s: %s", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		l.handle(frame, conn.RemoteAddr())
+	}
+}
+
+func (l *Listener) handle(b []byte, from net.Addr) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return
+	}
+	m, err := Parse(b, time.Now(), l.Location)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Skipping invalid syslog message from %s: %s", from, err))
+		return
+	}
+	if m.Hostname == "" {
+		m.Hostname, _, _ = net.SplitHostPort(from.String())
+	}
+	l.Process(m.Event())
+}
+
+// Read the next message of a stream. Octet counted frames start with the
+// message length, anything else runs up to the next LF
+func readFrame(br *bufio.Reader) ([]byte, error) {
+	c, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if c[0] >= '1' && c[0] <= '9' {
+		prefix, err := br.ReadSlice(' ')
+		if err != nil {
+			return nil, fmt.Errorf("invalid octet count: %w", err)
+		}
+		n, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+		if err != nil || n > maxMessageSize {
+			return nil, fmt.Errorf("invalid octet count %q", prefix)
+		}
+		frame := make([]byte, n)
+		_, err = io.ReadFull(br, frame)
+		return frame, err
+	}
+
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("message longer than %d bytes", maxMessageSize)
+	}
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		return nil, err
+	}
+	return bytes.Clone(line), nil
+}